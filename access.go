@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	authv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Check the watcher may list and watch a resource in each of the namespaces,
+// all of them for v1.NamespaceAll. An informer without these rights never
+// syncs, which would block whatever waits for it
+func watchAllowed(client kubernetes.Interface, resource schema.GroupVersionResource, namespaces []string) error {
+	var denied []string
+	for _, namespace := range namespaces {
+		for _, verb := range []string{"list", "watch"} {
+			review := &authv1.SelfSubjectAccessReview{
+				Spec: authv1.SelfSubjectAccessReviewSpec{
+					ResourceAttributes: &authv1.ResourceAttributes{
+						Namespace: namespace,
+						Verb:      verb,
+						Group:     resource.Group,
+						Version:   resource.Version,
+						Resource:  resource.Resource,
+					},
+				},
+			}
+			review, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(context.Background(), review, metav1.CreateOptions{})
+			if err != nil {
+				return fmt.Errorf("failed to check access to %s: %s", resource.GroupResource(), err)
+			}
+			if !review.Status.Allowed {
+				where := "cluster wide"
+				if namespace != v1.NamespaceAll {
+					where = fmt.Sprintf("in namespace '%s'", namespace)
+				}
+				denied = append(denied, fmt.Sprintf("%s %s", verb, where))
+			}
+		}
+	}
+	if len(denied) > 0 {
+		return fmt.Errorf("not allowed to %s %s", resource.GroupResource(), strings.Join(denied, ", "))
+	}
+	return nil
+}
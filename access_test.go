@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	authv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestWatchAllowed(t *testing.T) {
+	// Allowed to list everywhere, and to watch in team-a only
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authv1.SelfSubjectAccessReview)
+		attributes := review.Spec.ResourceAttributes
+		review.Status.Allowed = attributes.Resource == "routes" &&
+			(attributes.Verb == "list" || attributes.Namespace == "team-a")
+		return true, review, nil
+	})
+
+	tests := []struct {
+		name       string
+		namespaces []string
+		// Part of the error, if not allowed
+		err string
+	}{
+		{
+			name:       "allowed namespace",
+			namespaces: []string{"team-a"},
+		},
+		{
+			name:       "denied namespace",
+			namespaces: []string{"team-a", "team-b"},
+			err:        "not allowed to routes.route.openshift.io watch in namespace 'team-b'",
+		},
+		{
+			name:       "cluster wide",
+			namespaces: []string{v1.NamespaceAll},
+			err:        "watch cluster wide",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := watchAllowed(client, RouteResource, tt.namespaces)
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Backends storing the clients, selected by flag
+const (
+	BackendDex    = "dex"
+	BackendMemory = "memory"
+)
+
+// Error of backends asked to change a client they hold but the watcher didn't
+// register, which is left as it is
+var errUnmanagedClient = errors.New("exists but isn't managed by the watcher")
+
+// Store of OAuth2 clients the reconciler registers clients in
+type Backend interface {
+	// Create a client, or update it if it already exists
+	Ensure(ctx context.Context, client *staticClient) error
+	// Delete a client, deleting a missing client isn't an error
+	Delete(ctx context.Context, client *staticClient) error
+	// Return a client, or nil if it doesn't exist
+	Get(ctx context.Context, id string) (*staticClient, error)
+	// Return all clients
+	List(ctx context.Context) ([]*staticClient, error)
+	// Check the backend can be used
+	Health(ctx context.Context) error
+}
+
+// Backend keeping the clients in memory, to try the watcher out without an
+// identity provider
+type memoryBackend struct {
+	mu      sync.Mutex
+	clients map[string]*staticClient
+}
+
+// Return a new empty in-memory backend
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{
+		clients: make(map[string]*staticClient),
+	}
+}
+
+func (b *memoryBackend) Ensure(ctx context.Context, client *staticClient) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := *client
+	b.clients[client.Id] = &c
+	log.Infof("Memory: stored client '%s' at callback '%s'", client.Id, strings.Join(client.RedirectURIs, ","))
+	return nil
+}
+
+func (b *memoryBackend) Delete(ctx context.Context, client *staticClient) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.clients, client.Id)
+	log.Infof("Memory: deleted client '%s'", client.Id)
+	return nil
+}
+
+func (b *memoryBackend) Get(ctx context.Context, id string) (*staticClient, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	client, ok := b.clients[id]
+	if !ok {
+		return nil, nil
+	}
+	c := *client
+	return &c, nil
+}
+
+func (b *memoryBackend) List(ctx context.Context) ([]*staticClient, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	clients := make([]*staticClient, 0, len(b.clients))
+	for _, client := range b.clients {
+		c := *client
+		clients = append(clients, &c)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Id < clients[j].Id
+	})
+	return clients, nil
+}
+
+func (b *memoryBackend) Health(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// Annotation written back to the objects, listing the client ids registered
+	// in Dex for them when a client id template is used
+	AnnotationDexStaticClientEffectiveId = "-effective-client-id"
+	// Template used by --namespace-client-ids
+	NamespaceClientIDTemplate = "{{.Namespace}}-{{.ClientID}}"
+)
+
+// Template turning the client ids of the objects into the ones registered in
+// Dex, set by flag. Client ids are used verbatim without it
+var clientIDTemplate *template.Template
+
+// Values available to the client id template
+type clientIDTemplateData struct {
+	ClientID  string
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+// Parse a client id template
+func parseClientIDTemplate(text string) (*template.Template, error) {
+	return template.New("client-id").Option("missingkey=error").Parse(text)
+}
+
+// Replace the client ids of an object's clients with the ones to register in Dex
+func applyClientIDTemplate(ref objectRef, clients []*staticClient) error {
+	if clientIDTemplate == nil {
+		return nil
+	}
+
+	ids := make(map[string]bool)
+	for _, client := range clients {
+		id, err := executeClientIDTemplate(ref, client.Id)
+		if err != nil {
+			return fmt.Errorf("client '%s': %s", client.Id, err)
+		}
+		if id == "" {
+			return fmt.Errorf("client '%s': client id template gives an empty id", client.Id)
+		}
+		if ids[id] {
+			return fmt.Errorf("client '%s': client id '%s' defined more than once", client.Id, id)
+		}
+		ids[id] = true
+		client.Id = id
+
+		// Trusted peers name other clients, rewritten the same way
+		var peers []string
+		for _, peer := range client.TrustedPeers {
+			peer, err := executeClientIDTemplate(ref, peer)
+			if err != nil {
+				return fmt.Errorf("client '%s': trusted peer: %s", client.Id, err)
+			}
+			peers = append(peers, peer)
+		}
+		client.TrustedPeers = peers
+	}
+	return nil
+}
+
+// Return the client id registered in Dex for a client id of an object
+func executeClientIDTemplate(ref objectRef, id string) (string, error) {
+	var buf bytes.Buffer
+	err := clientIDTemplate.Execute(&buf, clientIDTemplateData{
+		ClientID:  id,
+		Kind:      ref.Kind,
+		Namespace: ref.Namespace,
+		Name:      ref.Name,
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// Write the client ids registered in Dex for an object back to its
+// effective-client-id annotation, if they were rewritten and changed. Clients
+// refused by the policy or losing a collision aren't listed
+func (r *reconciler) publishClientIDs(ref objectRef, ann map[string]string, ids []string, rewritten bool) {
+	if r.dynamicClient == nil {
+		return
+	}
+
+	key := annotationName(AnnotationDexStaticClientEffectiveId)
+	current, ok := ann[key]
+	if !rewritten {
+		// Client ids are used verbatim, drop any annotation left from before
+		ids = nil
+	}
+	var value interface{}
+	switch {
+	case len(ids) > 0 && current != strings.Join(ids, ","):
+		value = strings.Join(ids, ",")
+	case len(ids) == 0 && ok:
+		// Removes the annotation
+		value = nil
+	default:
+		return
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{key: value},
+		},
+	})
+	if err != nil {
+		log.Errorf("Failed to build patch for %s '%s' from namespace '%s' - %s", ref.Kind, ref.Name, ref.Namespace, err)
+		return
+	}
+
+	_, err = r.dynamicClient.Resource(ref.Resource).Namespace(ref.Namespace).Patch(context.TODO(), ref.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		log.Warnf("Failed to write client ids back to %s '%s' from namespace '%s' - %s", ref.Kind, ref.Name, ref.Namespace, err)
+		return
+	}
+	log.Infof("Wrote client ids '%s' back to %s '%s' from namespace '%s'", strings.Join(ids, ","), ref.Kind, ref.Name, ref.Namespace)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyClientIDTemplate(t *testing.T) {
+	saved := clientIDTemplate
+	defer func() { clientIDTemplate = saved }()
+
+	var err error
+	clientIDTemplate, err = parseClientIDTemplate(NamespaceClientIDTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := testRef("team-a", "app", 0)
+
+	tests := []struct {
+		name    string
+		clients []*staticClient
+		// Client ids and trusted peers once rewritten
+		wantIDs   []string
+		wantPeers [][]string
+		err       string
+	}{
+		{
+			name: "ids and trusted peers",
+			clients: []*staticClient{
+				{Id: "app", TrustedPeers: []string{"cli", "web"}},
+				{Id: "cli"},
+			},
+			wantIDs:   []string{"team-a-app", "team-a-cli"},
+			wantPeers: [][]string{{"team-a-cli", "team-a-web"}, nil},
+		},
+		{
+			name: "same id twice",
+			clients: []*staticClient{
+				{Id: "app"},
+				{Id: "app"},
+			},
+			err: "client id 'team-a-app' defined more than once",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := applyClientIDTemplate(ref, tt.clients)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, client := range tt.clients {
+				if client.Id != tt.wantIDs[i] || !reflect.DeepEqual(client.TrustedPeers, tt.wantPeers[i]) {
+					t.Errorf("expected client %s with peers %v, got %s with %v", tt.wantIDs[i], tt.wantPeers[i], client.Id, client.TrustedPeers)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+// Dex gRPC calls which are served by current Dex releases, but are missing
+// from the github.com/coreos/dex/api package.
+
+import (
+	"context"
+
+	"github.com/coreos/dex/api"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+// UpdateClientReq is a request to update an existing client.
+// Empty fields are left untouched by Dex.
+type UpdateClientReq struct {
+	Id           string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	RedirectUris []string `protobuf:"bytes,2,rep,name=redirect_uris,json=redirectUris,proto3" json:"redirect_uris,omitempty"`
+	TrustedPeers []string `protobuf:"bytes,3,rep,name=trusted_peers,json=trustedPeers,proto3" json:"trusted_peers,omitempty"`
+	Name         string   `protobuf:"bytes,4,opt,name=name,proto3" json:"name,omitempty"`
+	LogoUrl      string   `protobuf:"bytes,5,opt,name=logo_url,json=logoUrl,proto3" json:"logo_url,omitempty"`
+}
+
+func (m *UpdateClientReq) Reset()         { *m = UpdateClientReq{} }
+func (m *UpdateClientReq) String() string { return proto.CompactTextString(m) }
+func (*UpdateClientReq) ProtoMessage()    {}
+
+// UpdateClientResp returns the response from updating a client.
+type UpdateClientResp struct {
+	NotFound bool `protobuf:"varint,1,opt,name=not_found,json=notFound,proto3" json:"not_found,omitempty"`
+}
+
+func (m *UpdateClientResp) Reset()         { *m = UpdateClientResp{} }
+func (m *UpdateClientResp) String() string { return proto.CompactTextString(m) }
+func (*UpdateClientResp) ProtoMessage()    {}
+
+// GetClientReq is a request to read a client.
+type GetClientReq struct {
+	Id string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+}
+
+func (m *GetClientReq) Reset()         { *m = GetClientReq{} }
+func (m *GetClientReq) String() string { return proto.CompactTextString(m) }
+func (*GetClientReq) ProtoMessage()    {}
+
+// GetClientResp returns the client read.
+type GetClientResp struct {
+	Client *api.Client `protobuf:"bytes,1,opt,name=client,proto3" json:"client,omitempty"`
+}
+
+func (m *GetClientResp) Reset()         { *m = GetClientResp{} }
+func (m *GetClientResp) String() string { return proto.CompactTextString(m) }
+func (*GetClientResp) ProtoMessage()    {}
+
+// DexClient is the Dex gRPC client, extended with the calls above
+type DexClient interface {
+	api.DexClient
+	// UpdateClient updates an existing client
+	UpdateClient(ctx context.Context, in *UpdateClientReq, opts ...grpc.CallOption) (*UpdateClientResp, error)
+	// GetClient reads a client, with its secret
+	GetClient(ctx context.Context, in *GetClientReq, opts ...grpc.CallOption) (*GetClientResp, error)
+}
+
+type dexClient struct {
+	api.DexClient
+	cc *grpc.ClientConn
+}
+
+// Return a new DexClient using the given connection
+func NewDexClient(cc *grpc.ClientConn) DexClient {
+	return &dexClient{
+		DexClient: api.NewDexClient(cc),
+		cc:        cc,
+	}
+}
+
+func (c *dexClient) UpdateClient(ctx context.Context, in *UpdateClientReq, opts ...grpc.CallOption) (*UpdateClientResp, error) {
+	out := new(UpdateClientResp)
+	err := c.cc.Invoke(ctx, "/api.Dex/UpdateClient", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dexClient) GetClient(ctx context.Context, in *GetClientReq, opts ...grpc.CallOption) (*GetClientResp, error) {
+	out := new(GetClientResp)
+	err := c.cc.Invoke(ctx, "/api.Dex/GetClient", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
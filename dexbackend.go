@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/coreos/dex/api"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// Return a new Dex Client to perform gRPC calls with
+func newDexClient(grpcAddress string, caPath string, clientCrtPath string, clientKeyPath string) DexClient {
+	if caPath != "" && clientCrtPath != "" && clientKeyPath != "" {
+		cPool := x509.NewCertPool()
+
+		caCert, err := ioutil.ReadFile(caPath)
+		exitOnError(err)
+
+		if !cPool.AppendCertsFromPEM(caCert) {
+			log.Errorf("failed to parse CA crt")
+		}
+
+		clientCert, err := tls.LoadX509KeyPair(clientCrtPath, clientKeyPath)
+		exitOnError(err)
+
+		clientTLSConfig := &tls.Config{
+			RootCAs:      cPool,
+			Certificates: []tls.Certificate{clientCert},
+		}
+		creds := credentials.NewTLS(clientTLSConfig)
+		conn, err := grpc.Dial(grpcAddress, grpc.WithTransportCredentials(creds))
+		exitOnError(err)
+		return NewDexClient(conn)
+	} else {
+		if caPath != "" || clientCrtPath != "" || clientKeyPath != "" {
+			log.Warnf("Dex gRPC: TLS needs a CA, a client certificate and a client key, connecting to '%s' in plain text", grpcAddress)
+		}
+		conn, err := grpc.Dial(grpcAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		exitOnError(err)
+		return NewDexClient(conn)
+	}
+
+}
+
+// Backend registering the clients in Dex through its gRPC API. The API can't
+// read clients back, so Get and List return the clients registered by this process
+type dexBackend struct {
+	client DexClient
+
+	mu sync.Mutex
+	// Clients registered, by client id
+	clients map[string]*staticClient
+}
+
+// Return a new backend using the given Dex client
+func newDexBackend(client DexClient) *dexBackend {
+	return &dexBackend{
+		client:  client,
+		clients: make(map[string]*staticClient),
+	}
+}
+
+func (b *dexBackend) Ensure(ctx context.Context, client *staticClient) error {
+	b.mu.Lock()
+	old, ok := b.clients[client.Id]
+	b.mu.Unlock()
+
+	var err error
+	switch {
+	case !ok:
+		err = b.adopt(ctx, client)
+	case needsRecreate(old, client):
+		err = b.recreate(ctx, client)
+	default:
+		// Also done when nothing changed, to restore clients lost by Dex
+		err = b.updateOrCreate(ctx, client)
+	}
+	if err != nil {
+		return err
+	}
+
+	c := *client
+	b.mu.Lock()
+	b.clients[client.Id] = &c
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *dexBackend) Delete(ctx context.Context, client *staticClient) error {
+	if err := b.delete(ctx, client.Id); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	delete(b.clients, client.Id)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *dexBackend) Get(ctx context.Context, id string) (*staticClient, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	client, ok := b.clients[id]
+	if !ok {
+		return nil, nil
+	}
+	c := *client
+	return &c, nil
+}
+
+func (b *dexBackend) List(ctx context.Context) ([]*staticClient, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	clients := make([]*staticClient, 0, len(b.clients))
+	for _, client := range b.clients {
+		c := *client
+		clients = append(clients, &c)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Id < clients[j].Id
+	})
+	return clients, nil
+}
+
+func (b *dexBackend) Health(ctx context.Context) error {
+	_, err := b.client.GetVersion(ctx, &api.VersionReq{})
+	return err
+}
+
+// Register a client this process didn't register yet. One Dex already has was
+// registered before a restart, or by someone else, and is updated in place.
+// It is only deleted and created again when Dex reports another secret or
+// public flag, which can't be updated
+func (b *dexBackend) adopt(ctx context.Context, client *staticClient) error {
+	existing, err := b.get(ctx, client.Id)
+	switch {
+	case err != nil:
+		// Older Dex releases can't read clients
+		log.Warnf("Dex gRPC: updating client '%s' without checking its secret - %s", client.Id, err)
+		return b.updateOrCreate(ctx, client)
+	case existing == nil:
+		exists, err := b.create(ctx, client)
+		if err == nil && exists {
+			return fmt.Errorf("Dex gRPC: client '%s' was created concurrently", client.Id)
+		}
+		return err
+	case existing.Secret != client.Secret || existing.Public != client.Public:
+		log.Warnf("Dex gRPC: client '%s' has another secret or public flag - creating it again", client.Id)
+		return b.recreate(ctx, client)
+	}
+	return b.updateOrCreate(ctx, client)
+}
+
+// Update a client, creating it if Dex lost it
+func (b *dexBackend) updateOrCreate(ctx context.Context, client *staticClient) error {
+	notFound, err := b.update(ctx, client)
+	if err != nil || !notFound {
+		return err
+	}
+	log.Warnf("Dex gRPC: client '%s' not found - creating it", client.Id)
+	exists, err := b.create(ctx, client)
+	if err == nil && exists {
+		// Created by someone else in between, left to the next sync
+		return fmt.Errorf("Dex gRPC: client '%s' was created concurrently", client.Id)
+	}
+	return err
+}
+
+// Delete a client and create it again
+func (b *dexBackend) recreate(ctx context.Context, client *staticClient) error {
+	if err := b.delete(ctx, client.Id); err != nil {
+		return err
+	}
+	exists, err := b.create(ctx, client)
+	if err == nil && exists {
+		return fmt.Errorf("Dex gRPC: client '%s' was created concurrently", client.Id)
+	}
+	return err
+}
+
+// Add Dex StaticClient via gRPC. Returns whether Dex already has it, in which
+// case nothing is changed
+func (b *dexBackend) create(ctx context.Context, client *staticClient) (bool, error) {
+	req := &api.CreateClientReq{
+		Client: &api.Client{
+			Id:           client.Id,
+			Name:         client.Name,
+			Secret:       client.Secret,
+			RedirectUris: client.RedirectURIs,
+			TrustedPeers: client.TrustedPeers,
+			Public:       client.Public,
+			LogoUrl:      client.LogoURL,
+		},
+	}
+
+	resp, err := b.client.CreateClient(ctx, req)
+	if err != nil {
+		return false, fmt.Errorf("Dex gRPC: failed to create client '%s': %s", client.Id, err)
+	}
+	if resp.AlreadyExists {
+		return true, nil
+	}
+	log.Infof("Dex gRPC: Successfully created client '%s'", client.Id)
+	return false, nil
+}
+
+// Update an existing Dex StaticClient via gRPC. Returns whether Dex doesn't
+// know it, in which case nothing is changed
+func (b *dexBackend) update(ctx context.Context, client *staticClient) (bool, error) {
+	req := &UpdateClientReq{
+		Id:           client.Id,
+		Name:         client.Name,
+		RedirectUris: client.RedirectURIs,
+		TrustedPeers: client.TrustedPeers,
+		LogoUrl:      client.LogoURL,
+	}
+
+	resp, err := b.client.UpdateClient(ctx, req)
+	if err != nil {
+		return false, fmt.Errorf("Dex gRPC: failed to update client '%s': %s", client.Id, err)
+	}
+	if resp.NotFound {
+		return true, nil
+	}
+	log.Infof("Dex gRPC: Successfully updated client '%s'", client.Id)
+	return false, nil
+}
+
+// Read a Dex StaticClient via gRPC, nil if Dex doesn't have it
+func (b *dexBackend) get(ctx context.Context, id string) (*api.Client, error) {
+	resp, err := b.client.GetClient(ctx, &GetClientReq{Id: id})
+	if err != nil {
+		// Dex reports missing clients without a status code
+		if s := status.Convert(err); s.Code() == codes.NotFound || s.Message() == "not found" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read client '%s': %s", id, err)
+	}
+	return resp.Client, nil
+}
+
+// Delete Dex StaticClient via gRPC
+func (b *dexBackend) delete(ctx context.Context, id string) error {
+	resp, err := b.client.DeleteClient(ctx, &api.DeleteClientReq{Id: id})
+	if err != nil {
+		return fmt.Errorf("Dex gRPC: failed to delete client '%s': %s", id, err)
+	}
+	if resp.NotFound {
+		log.Warnf("Dex gPRC: client '%s' could not be deleted - not found", id)
+	} else {
+		log.Infof("Dex gRPC: Successfully deleted client '%s'", id)
+	}
+	return nil
+}
+
+// Dex can't update the secret or public flag of a client, and ignores empty
+// fields on update, so such changes need the client to be deleted and created again
+func needsRecreate(old, client *staticClient) bool {
+	return old.Secret != client.Secret ||
+		old.Public != client.Public ||
+		(old.LogoURL != "" && client.LogoURL == "") ||
+		(len(old.TrustedPeers) > 0 && len(client.TrustedPeers) == 0)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/coreos/dex/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Dex gRPC API keeping clients in memory. With racing set, clients are
+// deleted by someone else once created and created by someone else once deleted
+type fakeDexClient struct {
+	api.DexClient
+	clients map[string]*api.Client
+	racing  bool
+	// Whether GetClient isn't served, as by older Dex releases
+	noGet bool
+	calls []string
+	// Answer of GetVersion, if set
+	version func(ctx context.Context) error
+}
+
+func newFakeDexClient() *fakeDexClient {
+	return &fakeDexClient{clients: make(map[string]*api.Client)}
+}
+
+func (f *fakeDexClient) CreateClient(ctx context.Context, in *api.CreateClientReq, opts ...grpc.CallOption) (*api.CreateClientResp, error) {
+	f.calls = append(f.calls, "create")
+	if _, ok := f.clients[in.Client.Id]; ok || f.racing {
+		return &api.CreateClientResp{AlreadyExists: true}, nil
+	}
+	f.clients[in.Client.Id] = in.Client
+	return &api.CreateClientResp{Client: in.Client}, nil
+}
+
+func (f *fakeDexClient) UpdateClient(ctx context.Context, in *UpdateClientReq, opts ...grpc.CallOption) (*UpdateClientResp, error) {
+	f.calls = append(f.calls, "update")
+	client, ok := f.clients[in.Id]
+	if !ok || f.racing {
+		return &UpdateClientResp{NotFound: true}, nil
+	}
+	client.Name = in.Name
+	client.RedirectUris = in.RedirectUris
+	return &UpdateClientResp{}, nil
+}
+
+func (f *fakeDexClient) DeleteClient(ctx context.Context, in *api.DeleteClientReq, opts ...grpc.CallOption) (*api.DeleteClientResp, error) {
+	f.calls = append(f.calls, "delete")
+	_, ok := f.clients[in.Id]
+	delete(f.clients, in.Id)
+	return &api.DeleteClientResp{NotFound: !ok}, nil
+}
+
+func (f *fakeDexClient) GetClient(ctx context.Context, in *GetClientReq, opts ...grpc.CallOption) (*GetClientResp, error) {
+	f.calls = append(f.calls, "get")
+	if f.noGet {
+		return nil, status.Error(codes.Unimplemented, "unknown method GetClient for service api.Dex")
+	}
+	client, ok := f.clients[in.Id]
+	if !ok {
+		return nil, status.Error(codes.Unknown, "not found")
+	}
+	c := *client
+	return &GetClientResp{Client: &c}, nil
+}
+
+func (f *fakeDexClient) GetVersion(ctx context.Context, in *api.VersionReq, opts ...grpc.CallOption) (*api.VersionResp, error) {
+	if f.version != nil {
+		if err := f.version(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return &api.VersionResp{}, nil
+}
+
+func TestDexBackendEnsure(t *testing.T) {
+	dex := newFakeDexClient()
+	b := newDexBackend(dex)
+	ctx := context.Background()
+
+	client := &staticClient{Id: "app", Secret: "secret", RedirectURIs: []string{"https://app/cb"}}
+	if err := b.Ensure(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	client.RedirectURIs = []string{"https://app/callback"}
+	if err := b.Ensure(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	client.Secret = "rotated"
+	if err := b.Ensure(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(dex.calls, ","); got != "get,create,update,delete,create" {
+		t.Errorf("unexpected calls %s", got)
+	}
+	if got := dex.clients["app"]; got.Secret != "rotated" || got.RedirectUris[0] != "https://app/callback" {
+		t.Errorf("unexpected client %v", got)
+	}
+
+	// Lost by Dex
+	delete(dex.clients, "app")
+	dex.calls = nil
+	if err := b.Ensure(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(dex.calls, ","); got != "update,create" || dex.clients["app"] == nil {
+		t.Errorf("client not created again, calls %s", got)
+	}
+}
+
+func TestDexBackendRestart(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		public bool
+		noGet  bool
+		// Calls made, and secret Dex ends up with
+		calls      string
+		wantSecret string
+	}{
+		{
+			name:       "unchanged",
+			secret:     "old",
+			calls:      "get,update",
+			wantSecret: "old",
+		},
+		{
+			name:       "secret changed",
+			secret:     "new",
+			calls:      "get,delete,create",
+			wantSecret: "new",
+		},
+		{
+			name:       "public flag changed",
+			secret:     "old",
+			public:     true,
+			calls:      "get,delete,create",
+			wantSecret: "old",
+		},
+		{
+			name:       "secret unknown",
+			secret:     "new",
+			noGet:      true,
+			calls:      "get,update",
+			wantSecret: "old",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dex := newFakeDexClient()
+			dex.clients["app"] = &api.Client{Id: "app", Secret: "old", RedirectUris: []string{"https://app/cb"}}
+			dex.noGet = tt.noGet
+
+			// Fresh backend, as after a restart
+			b := newDexBackend(dex)
+			client := &staticClient{Id: "app", Secret: tt.secret, Public: tt.public, RedirectURIs: []string{"https://app/callback"}}
+			if err := b.Ensure(context.Background(), client); err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(dex.calls, ","); got != tt.calls {
+				t.Errorf("expected calls %s, got %s", tt.calls, got)
+			}
+			if got := dex.clients["app"]; got.Secret != tt.wantSecret || got.RedirectUris[0] != "https://app/callback" {
+				t.Errorf("unexpected client %v", got)
+			}
+		})
+	}
+}
+
+func TestDexBackendRacing(t *testing.T) {
+	ctx := context.Background()
+	client := &staticClient{Id: "app", Secret: "secret", RedirectURIs: []string{"https://app/cb"}}
+
+	// Created, then always deleted and created again by someone else
+	dex := newFakeDexClient()
+	b := newDexBackend(dex)
+	if err := b.Ensure(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	dex.racing = true
+	dex.calls = nil
+	if err := b.Ensure(ctx, client); err == nil {
+		t.Error("expected an error")
+	}
+	if got := strings.Join(dex.calls, ","); got != "update,create" {
+		t.Errorf("expected a single fallback, got calls %s", got)
+	}
+
+	// Found with another secret when first registered
+	dex = newFakeDexClient()
+	dex.clients["app"] = &api.Client{Id: "app", Secret: "old"}
+	dex.racing = true
+	b = newDexBackend(dex)
+	if err := b.Ensure(ctx, client); err == nil {
+		t.Error("expected an error")
+	}
+	if got := strings.Join(dex.calls, ","); got != "get,delete,create" {
+		t.Errorf("expected a single fallback, got calls %s", got)
+	}
+}
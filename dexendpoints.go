@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/etherlabsio/healthcheck"
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+)
+
+// Annotation of objects or namespaces naming the Dex endpoints to register
+// their clients with, comma separated. Object annotations win
+const AnnotationDexEndpoints = "-endpoints"
+
+// Time each Dex endpoint has to answer a health check of the metrics
+const DexEndpointHealthTimeout = 5 * time.Second
+
+// Dex endpoints the clients can be registered with, set by flag
+type dexEndpointsConfig struct {
+	Endpoints []*dexEndpointConfig `json:"endpoints"`
+}
+
+// A named Dex gRPC endpoint, and the namespaces whose clients go to it when
+// no annotation names endpoints
+type dexEndpointConfig struct {
+	Name      string `json:"name"`
+	Address   string `json:"address"`
+	CACrt     string `json:"caCrt,omitempty"`
+	ClientCrt string `json:"clientCrt,omitempty"`
+	ClientKey string `json:"clientKey,omitempty"`
+	// Glob patterns of the namespaces routed to the endpoint
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Whether clients of namespaces matching no endpoint go to the endpoint
+	Default bool `json:"default,omitempty"`
+}
+
+// Dex endpoints configured, nil when clients go to a single Dex
+var dexEndpoints *dexEndpointsConfig
+
+// Parse a YAML or JSON list of Dex endpoints
+func parseDexEndpointsConfig(data []byte) (*dexEndpointsConfig, error) {
+	data, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &dexEndpointsConfig{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, err
+	}
+
+	if len(c.Endpoints) == 0 {
+		return nil, fmt.Errorf("no endpoints")
+	}
+	names := make(map[string]bool)
+	for i, e := range c.Endpoints {
+		if e == nil || e.Name == "" || e.Address == "" {
+			return nil, fmt.Errorf("endpoint %d: name and address are required", i+1)
+		}
+		if names[e.Name] {
+			return nil, fmt.Errorf("endpoint %d: duplicate name '%s'", i+1, e.Name)
+		}
+		names[e.Name] = true
+		// Dex is reached in plain text unless all are set
+		tls := 0
+		for _, path := range []string{e.CACrt, e.ClientCrt, e.ClientKey} {
+			if path != "" {
+				tls++
+			}
+		}
+		if tls != 0 && tls != 3 {
+			return nil, fmt.Errorf("endpoint %d: caCrt, clientCrt and clientKey must be set together", i+1)
+		}
+		for _, pattern := range e.Namespaces {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("endpoint %d: invalid pattern '%s'", i+1, pattern)
+			}
+		}
+	}
+	return c, nil
+}
+
+// Read Dex endpoints from a file
+func loadDexEndpointsFile(endpointsPath string) (*dexEndpointsConfig, error) {
+	data, err := ioutil.ReadFile(endpointsPath)
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseDexEndpointsConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dex endpoints file '%s': %s", endpointsPath, err)
+	}
+	return c, nil
+}
+
+// Set the endpoints of the clients of a namespace naming none: those whose
+// namespace patterns match, or else the default ones. Fails on unknown
+// endpoint names, or when no endpoint is found
+func (c *dexEndpointsConfig) route(namespace string, clients []*staticClient) error {
+	for _, client := range clients {
+		if client == nil {
+			continue
+		}
+		if len(client.Endpoints) == 0 {
+			client.Endpoints = c.namespaceEndpoints(namespace)
+		}
+		if len(client.Endpoints) == 0 {
+			return fmt.Errorf("client '%s': no dex endpoint for namespace '%s'", client.Id, namespace)
+		}
+		for _, name := range client.Endpoints {
+			if c.endpoint(name) == nil {
+				return fmt.Errorf("client '%s': unknown dex endpoint '%s'", client.Id, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Return the endpoints for the clients of a namespace
+func (c *dexEndpointsConfig) namespaceEndpoints(namespace string) []string {
+	var names, defaults []string
+	for _, e := range c.Endpoints {
+		if len(e.Namespaces) > 0 && matchAny(e.Namespaces, namespace) {
+			names = append(names, e.Name)
+		}
+		if e.Default {
+			defaults = append(defaults, e.Name)
+		}
+	}
+	if len(names) > 0 {
+		return names
+	}
+	return defaults
+}
+
+// Return the endpoint with a name, or nil
+func (c *dexEndpointsConfig) endpoint(name string) *dexEndpointConfig {
+	for _, e := range c.Endpoints {
+		if e.Name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// A Dex endpoint, with the counts of the calls made to it
+type dexEndpoint struct {
+	name    string
+	backend *dexBackend
+
+	mu sync.Mutex
+	// Calls and failed calls, by operation
+	calls    map[string]uint64
+	failures map[string]uint64
+}
+
+// Count a call to the endpoint, returning its error
+func (e *dexEndpoint) count(operation string, err error) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.calls[operation]++
+	if err != nil {
+		e.failures[operation]++
+	}
+	return err
+}
+
+// Backend registering each client with the Dex endpoints it is routed to, and
+// deleting it from those it no longer is. Endpoints are tracked in memory, a
+// client moved away from an endpoint while the watcher was down stays there
+type multiDexBackend struct {
+	endpoints []*dexEndpoint
+
+	mu sync.Mutex
+	// Endpoints each client is registered with, by client id
+	registered map[string][]string
+}
+
+// Return a new backend connecting to the configured Dex endpoints
+func newMultiDexBackend(c *dexEndpointsConfig) *multiDexBackend {
+	b := &multiDexBackend{
+		registered: make(map[string][]string),
+	}
+	for _, e := range c.Endpoints {
+		b.endpoints = append(b.endpoints, &dexEndpoint{
+			name:     e.Name,
+			backend:  newDexBackend(newDexClient(e.Address, e.CACrt, e.ClientCrt, e.ClientKey)),
+			calls:    make(map[string]uint64),
+			failures: make(map[string]uint64),
+		})
+	}
+	return b
+}
+
+func (b *multiDexBackend) Ensure(ctx context.Context, client *staticClient) error {
+	b.mu.Lock()
+	old := b.registered[client.Id]
+	b.mu.Unlock()
+
+	for _, e := range b.endpoints {
+		if !contains(client.Endpoints, e.name) {
+			continue
+		}
+		if err := e.count("ensure", e.backend.Ensure(ctx, client)); err != nil {
+			return fmt.Errorf("dex endpoint '%s': %s", e.name, err)
+		}
+	}
+	for _, e := range b.endpoints {
+		if !contains(old, e.name) || contains(client.Endpoints, e.name) {
+			continue
+		}
+		if err := e.count("delete", e.backend.Delete(ctx, client)); err != nil {
+			return fmt.Errorf("dex endpoint '%s': %s", e.name, err)
+		}
+	}
+
+	b.mu.Lock()
+	b.registered[client.Id] = append([]string(nil), client.Endpoints...)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *multiDexBackend) Delete(ctx context.Context, client *staticClient) error {
+	b.mu.Lock()
+	old := b.registered[client.Id]
+	b.mu.Unlock()
+
+	for _, e := range b.endpoints {
+		if !contains(old, e.name) && !contains(client.Endpoints, e.name) {
+			continue
+		}
+		if err := e.count("delete", e.backend.Delete(ctx, client)); err != nil {
+			return fmt.Errorf("dex endpoint '%s': %s", e.name, err)
+		}
+	}
+
+	b.mu.Lock()
+	delete(b.registered, client.Id)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *multiDexBackend) Get(ctx context.Context, id string) (*staticClient, error) {
+	for _, e := range b.endpoints {
+		client, err := e.backend.Get(ctx, id)
+		if err != nil || client != nil {
+			return client, err
+		}
+	}
+	return nil, nil
+}
+
+func (b *multiDexBackend) List(ctx context.Context) ([]*staticClient, error) {
+	seen := make(map[string]bool)
+	var clients []*staticClient
+	for _, e := range b.endpoints {
+		list, err := e.backend.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, client := range list {
+			if !seen[client.Id] {
+				seen[client.Id] = true
+				clients = append(clients, client)
+			}
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Id < clients[j].Id
+	})
+	return clients, nil
+}
+
+// Check every endpoint can be reached
+func (b *multiDexBackend) Health(ctx context.Context) error {
+	var failed []string
+	for i, err := range b.health(ctx, 0) {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", b.endpoints[i].name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("dex endpoints not reachable: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Check the endpoints in parallel, each within its own timeout if set, and
+// return their errors in the order of the endpoints
+func (b *multiDexBackend) health(ctx context.Context, timeout time.Duration) []error {
+	errs := make([]error, len(b.endpoints))
+	var wg sync.WaitGroup
+	for i, e := range b.endpoints {
+		wg.Add(1)
+		go func(i int, e *dexEndpoint) {
+			defer wg.Done()
+			ctx := ctx
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			errs[i] = e.backend.Health(ctx)
+		}(i, e)
+	}
+	wg.Wait()
+	return errs
+}
+
+// Return a readiness checker for each endpoint, named after it
+func (b *multiDexBackend) checkers() []healthcheck.Option {
+	var options []healthcheck.Option
+	for _, e := range b.endpoints {
+		options = append(options, healthcheck.WithChecker("dex-"+e.name, healthcheck.CheckerFunc(e.backend.Health)))
+	}
+	return options
+}
+
+// Serve the metrics of each endpoint, in the Prometheus text format: whether
+// it can be reached, the calls made to it and the failed ones
+func (b *multiDexBackend) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+	buf.WriteString("# HELP dex_k8s_ingress_watcher_dex_endpoint_up Whether the dex endpoint can be reached.\n")
+	buf.WriteString("# TYPE dex_k8s_ingress_watcher_dex_endpoint_up gauge\n")
+	for i, err := range b.health(req.Context(), DexEndpointHealthTimeout) {
+		up := 1
+		if err != nil {
+			up = 0
+		}
+		fmt.Fprintf(&buf, "dex_k8s_ingress_watcher_dex_endpoint_up{endpoint=%q} %d\n", b.endpoints[i].name, up)
+	}
+
+	buf.WriteString("# HELP dex_k8s_ingress_watcher_dex_endpoint_calls_total Calls made to the dex endpoint.\n")
+	buf.WriteString("# TYPE dex_k8s_ingress_watcher_dex_endpoint_calls_total counter\n")
+	b.writeCounts(&buf, "dex_k8s_ingress_watcher_dex_endpoint_calls_total", func(e *dexEndpoint) map[string]uint64 { return e.calls })
+	buf.WriteString("# HELP dex_k8s_ingress_watcher_dex_endpoint_failures_total Failed calls to the dex endpoint.\n")
+	buf.WriteString("# TYPE dex_k8s_ingress_watcher_dex_endpoint_failures_total counter\n")
+	b.writeCounts(&buf, "dex_k8s_ingress_watcher_dex_endpoint_failures_total", func(e *dexEndpoint) map[string]uint64 { return e.failures })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Warnf("Failed to write dex endpoint metrics: %s", err)
+	}
+}
+
+// Write a counter of each endpoint, by operation
+func (b *multiDexBackend) writeCounts(buf *bytes.Buffer, metric string, counts func(*dexEndpoint) map[string]uint64) {
+	for _, e := range b.endpoints {
+		e.mu.Lock()
+		for _, operation := range []string{"ensure", "delete"} {
+			fmt.Fprintf(buf, "%s{endpoint=%q,operation=%q} %d\n", metric, e.name, operation, counts(e)[operation])
+		}
+		e.mu.Unlock()
+	}
+}
+
+// Return whether a list holds a value
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
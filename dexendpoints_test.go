@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Return a backend for fake Dex endpoints with the given names
+func newTestMultiDex(names ...string) (*multiDexBackend, map[string]*fakeDexClient) {
+	b := &multiDexBackend{registered: make(map[string][]string)}
+	fakes := make(map[string]*fakeDexClient)
+	for _, name := range names {
+		fakes[name] = newFakeDexClient()
+		b.endpoints = append(b.endpoints, &dexEndpoint{
+			name:     name,
+			backend:  newDexBackend(fakes[name]),
+			calls:    make(map[string]uint64),
+			failures: make(map[string]uint64),
+		})
+	}
+	return b, fakes
+}
+
+func TestParseDexEndpointsConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		endpoints string
+		err       string
+	}{
+		{
+			name:      "plain text",
+			endpoints: "endpoints:\n- {name: a, address: dex:5557, default: true}\n",
+		},
+		{
+			name:      "tls",
+			endpoints: "endpoints:\n- {name: a, address: dex:5557, caCrt: ca.crt, clientCrt: tls.crt, clientKey: tls.key}\n",
+		},
+		{
+			name:      "ca only",
+			endpoints: "endpoints:\n- {name: a, address: dex:5557, caCrt: ca.crt}\n",
+			err:       "endpoint 1: caCrt, clientCrt and clientKey must be set together",
+		},
+		{
+			name:      "no key",
+			endpoints: "endpoints:\n- {name: a, address: dex:5557}\n- {name: b, address: dex:5557, caCrt: ca.crt, clientCrt: tls.crt}\n",
+			err:       "endpoint 2: caCrt, clientCrt and clientKey must be set together",
+		},
+		{
+			name: "no endpoints",
+			err:  "no endpoints",
+		},
+		{
+			name:      "no address",
+			endpoints: "endpoints:\n- {name: a}\n",
+			err:       "endpoint 1: name and address are required",
+		},
+		{
+			name:      "duplicate name",
+			endpoints: "endpoints:\n- {name: a, address: dex:5557}\n- {name: a, address: dex2:5557}\n",
+			err:       "endpoint 2: duplicate name 'a'",
+		},
+		{
+			name:      "invalid pattern",
+			endpoints: "endpoints:\n- {name: a, address: dex:5557, namespaces: [\"[\"]}\n",
+			err:       "endpoint 1: invalid pattern '['",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseDexEndpointsConfig([]byte(tt.endpoints))
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestMultiDexHealthParallel(t *testing.T) {
+	b, fakes := newTestMultiDex("a", "b", "c")
+
+	// Each check waits for all of them to have started, so checks made one
+	// after the other time out
+	var mu sync.Mutex
+	waiting := len(fakes)
+	all := make(chan struct{})
+	for _, f := range fakes {
+		f.version = func(ctx context.Context) error {
+			mu.Lock()
+			if waiting--; waiting == 0 {
+				close(all)
+			}
+			mu.Unlock()
+			select {
+			case <-all:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := b.Health(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultiDexHealthTimeout(t *testing.T) {
+	b, fakes := newTestMultiDex("fast", "slow")
+	fakes["slow"].version = func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	errs := b.health(context.Background(), 10*time.Millisecond)
+	if errs[0] != nil || errs[1] != context.DeadlineExceeded {
+		t.Errorf("expected only the slow endpoint to time out, got %v", errs)
+	}
+}
+
+func TestMultiDexMetrics(t *testing.T) {
+	b, fakes := newTestMultiDex("up", "down")
+	fakes["down"].version = func(ctx context.Context) error {
+		return fmt.Errorf("unavailable")
+	}
+	ctx := context.Background()
+
+	client := &staticClient{Id: "app", Secret: "secret", RedirectURIs: []string{"https://app/cb"}, Endpoints: []string{"up"}}
+	if err := b.Ensure(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	fakes["up"].racing = true
+	if err := b.Ensure(ctx, client); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`dex_k8s_ingress_watcher_dex_endpoint_up{endpoint="up"} 1`,
+		`dex_k8s_ingress_watcher_dex_endpoint_up{endpoint="down"} 0`,
+		`dex_k8s_ingress_watcher_dex_endpoint_calls_total{endpoint="up",operation="ensure"} 2`,
+		`dex_k8s_ingress_watcher_dex_endpoint_failures_total{endpoint="up",operation="ensure"} 1`,
+		`dex_k8s_ingress_watcher_dex_endpoint_calls_total{endpoint="down",operation="ensure"} 0`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("expected %s in:\n%s", line, w.Body.String())
+		}
+	}
+}
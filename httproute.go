@@ -0,0 +1,65 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Gateway API group, and its versions serving HTTPRoutes by order of preference
+const GatewayAPIGroup = "gateway.networking.k8s.io"
+
+var httpRouteVersions = []string{"v1", "v1beta1", "v1alpha2"}
+
+// Resource handler for Gateway API HTTPRoutes, read through the dynamic client
+type HTTPRouteClient struct {
+	reconciler *reconciler
+	resource   schema.GroupVersionResource
+}
+
+func NewHTTPRouteClient(r *reconciler, resource schema.GroupVersionResource) *HTTPRouteClient {
+	return &HTTPRouteClient{
+		reconciler: r,
+		resource:   resource,
+	}
+}
+
+// Handle Client creation on HTTPRoute event
+func (c *HTTPRouteClient) OnAdd(obj interface{}) {
+
+	const kind = "HTTPRoute"
+
+	o, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		log.Warnf("Got an unexpected, unsupported, object. Not an HTTPRoute")
+		return
+	}
+
+	log.Debugf("Checking %s for clients '%s' from namespace '%s' ...", kind, o.GetName(), o.GetNamespace())
+
+	// Redirect URIs can be built for each hostname with templates or a callback path
+	hosts, _, _ := unstructured.NestedStringSlice(o.Object, "spec", "hostnames")
+	tdata := newTemplateData(kind, o, hosts)
+	clients, err := extractClients(o.GetAnnotations(), tdata)
+	reconcileObject(c.reconciler, newObjectRef(kind, c.resource, o), tdata, clients, err)
+}
+
+// Handle HTTPRoute update event
+func (c *HTTPRouteClient) OnUpdate(oldObj, newObj interface{}) {
+	c.OnAdd(newObj)
+}
+
+// Handle HTTPRoute deletion event
+func (c *HTTPRouteClient) OnDelete(obj interface{}) {
+	const kind = "HTTPRoute"
+
+	o, ok := deletedObject(obj).(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	log.Debugf("Checking %s for client deletion for '%s' from namespace '%s' ...", kind, o.GetName(), o.GetNamespace())
+
+	c.reconciler.remove(newObjectRef(kind, c.resource, o))
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	BackendHydra = "hydra"
+
+	// Metadata key marking the Hydra clients managed by the watcher
+	HydraManagedByMetadata = "managed-by"
+)
+
+// Hydra OAuth2 client, as represented by the admin API
+type hydraClient struct {
+	ClientID                string   `json:"client_id"`
+	ClientName              string   `json:"client_name,omitempty"`
+	ClientSecret            string   `json:"client_secret,omitempty"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	GrantTypes              []string `json:"grant_types,omitempty"`
+	ResponseTypes           []string `json:"response_types,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+	LogoURI                 string   `json:"logo_uri,omitempty"`
+	// Any JSON object, set by whoever manages the client
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// Backend registering the clients as OAuth2 clients of Ory Hydra, through its
+// admin API. Clients not created by the watcher are left alone
+type hydraBackend struct {
+	url        string
+	httpClient *http.Client
+}
+
+// Return a new backend for the Hydra admin API at the given URL
+func newHydraBackend(adminURL string) (*hydraBackend, error) {
+	if adminURL == "" {
+		return nil, fmt.Errorf("the hydra backend needs --hydra-admin-url")
+	}
+	return &hydraBackend{
+		url:        strings.TrimRight(adminURL, "/"),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (b *hydraBackend) Ensure(ctx context.Context, client *staticClient) error {
+	hc := newHydraClient(client)
+	existing, err := b.get(ctx, hc.ClientID)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return b.create(ctx, hc)
+	}
+	return b.update(ctx, hc, existing)
+}
+
+func (b *hydraBackend) Delete(ctx context.Context, client *staticClient) error {
+	existing, err := b.get(ctx, client.Id)
+	if err != nil {
+		return err
+	}
+	if existing != nil && !existing.managed() {
+		return fmt.Errorf("Hydra: client '%s' %w", client.Id, errUnmanagedClient)
+	}
+
+	status, err := b.do(ctx, http.MethodDelete, b.clientPath(client.Id), nil, nil)
+	switch {
+	case status == http.StatusNotFound:
+		log.Warnf("Hydra: client '%s' could not be deleted - not found", client.Id)
+	case err != nil:
+		return fmt.Errorf("Hydra: failed to delete client '%s': %s", client.Id, err)
+	default:
+		log.Infof("Hydra: Successfully deleted client '%s'", client.Id)
+	}
+	return nil
+}
+
+func (b *hydraBackend) Get(ctx context.Context, id string) (*staticClient, error) {
+	existing, err := b.get(ctx, id)
+	if err != nil || existing == nil {
+		return nil, err
+	}
+	return existing.staticClient(), nil
+}
+
+// Return the clients managed by the watcher, following the pages of the list
+func (b *hydraBackend) List(ctx context.Context) ([]*staticClient, error) {
+	var clients []*staticClient
+	path := "/admin/clients?page_size=500"
+	for path != "" {
+		var hcs []*hydraClient
+		next, err := b.list(ctx, path, &hcs)
+		if err != nil {
+			return nil, fmt.Errorf("Hydra: failed to list clients: %s", err)
+		}
+		for _, hc := range hcs {
+			if hc.managed() {
+				clients = append(clients, hc.staticClient())
+			}
+		}
+		path = next
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Id < clients[j].Id
+	})
+	return clients, nil
+}
+
+func (b *hydraBackend) Health(ctx context.Context) error {
+	_, err := b.do(ctx, http.MethodGet, "/health/alive", nil, nil)
+	return err
+}
+
+// Return the Hydra client for a client
+func newHydraClient(client *staticClient) *hydraClient {
+	hc := &hydraClient{
+		ClientID:                client.Id,
+		ClientName:              client.Name,
+		ClientSecret:            client.Secret,
+		RedirectURIs:            client.RedirectURIs,
+		GrantTypes:              []string{"authorization_code", "refresh_token"},
+		ResponseTypes:           []string{"code"},
+		TokenEndpointAuthMethod: "client_secret_basic",
+		LogoURI:                 client.LogoURL,
+		Metadata:                map[string]interface{}{HydraManagedByMetadata: ManagedByValue},
+	}
+	if client.Public {
+		hc.TokenEndpointAuthMethod = "none"
+		hc.ClientSecret = ""
+	}
+	return hc
+}
+
+// Return the client, as the watcher sees it
+func (hc *hydraClient) staticClient() *staticClient {
+	return &staticClient{
+		Id:           hc.ClientID,
+		Name:         hc.ClientName,
+		Secret:       hc.ClientSecret,
+		RedirectURIs: hc.RedirectURIs,
+		Public:       hc.TokenEndpointAuthMethod == "none",
+		LogoURL:      hc.LogoURI,
+	}
+}
+
+// Return whether the client was created by the watcher
+func (hc *hydraClient) managed() bool {
+	managedBy, _ := hc.Metadata[HydraManagedByMetadata].(string)
+	return managedBy == ManagedByValue
+}
+
+// Add Hydra client
+func (b *hydraBackend) create(ctx context.Context, hc *hydraClient) error {
+	status, err := b.do(ctx, http.MethodPost, "/admin/clients", hc, nil)
+	switch {
+	case status == http.StatusConflict:
+		// Left to the next sync, which updates it
+		return fmt.Errorf("Hydra: client '%s' was created concurrently", hc.ClientID)
+	case err != nil:
+		return fmt.Errorf("Hydra: failed to create client '%s': %s", hc.ClientID, err)
+	}
+	log.Infof("Hydra: Successfully created client '%s'", hc.ClientID)
+	return nil
+}
+
+// Update an existing Hydra client, as read
+func (b *hydraBackend) update(ctx context.Context, hc *hydraClient, existing *hydraClient) error {
+	if !existing.managed() {
+		return fmt.Errorf("Hydra: client '%s' %w", hc.ClientID, errUnmanagedClient)
+	}
+	// Other metadata is kept
+	for k, v := range existing.Metadata {
+		if _, ok := hc.Metadata[k]; !ok {
+			hc.Metadata[k] = v
+		}
+	}
+
+	if _, err := b.do(ctx, http.MethodPut, b.clientPath(hc.ClientID), hc, nil); err != nil {
+		return fmt.Errorf("Hydra: failed to update client '%s': %s", hc.ClientID, err)
+	}
+	log.Infof("Hydra: Successfully updated client '%s'", hc.ClientID)
+	return nil
+}
+
+// Return the Hydra client with a client id, or nil if there is none
+func (b *hydraBackend) get(ctx context.Context, id string) (*hydraClient, error) {
+	var hc hydraClient
+	status, err := b.do(ctx, http.MethodGet, b.clientPath(id), nil, &hc)
+	switch {
+	case status == http.StatusNotFound:
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("Hydra: failed to read client '%s': %s", id, err)
+	}
+	return &hc, nil
+}
+
+// Path of a client
+func (b *hydraBackend) clientPath(id string) string {
+	return "/admin/clients/" + url.PathEscape(id)
+}
+
+// Read a page of clients, returning the path of the next page, if any
+func (b *hydraBackend) list(ctx context.Context, path string, out *[]*hydraClient) (string, error) {
+	resp, err := b.request(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := hydraError(http.MethodGet, path, resp); err != nil {
+		return "", err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return "", err
+	}
+
+	// Pages are linked with a header like <...>; rel="next"
+	if len(*out) == 0 {
+		return "", nil
+	}
+	for _, link := range strings.Split(resp.Header.Get("Link"), ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 || strings.TrimSpace(parts[1]) != `rel="next"` {
+			continue
+		}
+		next, err := url.Parse(strings.Trim(strings.TrimSpace(parts[0]), "<>"))
+		if err != nil {
+			return "", err
+		}
+		return next.RequestURI(), nil
+	}
+	return "", nil
+}
+
+// Call the admin API, sending in and decoding the response into out, if not nil.
+// Return the status of the response along with any error
+func (b *hydraBackend) do(ctx context.Context, method string, path string, in interface{}, out interface{}) (int, error) {
+	resp, err := b.request(ctx, method, path, in)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if err := hydraError(method, path, resp); err != nil {
+		return resp.StatusCode, err
+	}
+	if out == nil {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Send a request to the admin API
+func (b *hydraBackend) request(ctx context.Context, method string, path string, in interface{}) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, b.url+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return b.httpClient.Do(req)
+}
+
+// Return an error for a response without a 2xx status
+func hydraError(method string, path string, resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s %s: %s %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Stub of Hydra's admin API, keeping clients as raw JSON objects
+type hydraStub struct {
+	mu      sync.Mutex
+	clients map[string]map[string]interface{}
+	// Methods of the client requests made
+	requests []string
+}
+
+func (s *hydraStub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := strings.TrimPrefix(req.URL.Path, "/admin/clients/")
+	if strings.HasPrefix(req.URL.Path, "/admin/clients") {
+		s.requests = append(s.requests, req.Method)
+	}
+	switch {
+	case req.URL.Path == "/health/alive":
+		w.Write([]byte(`{"status":"ok"}`))
+	case req.Method == http.MethodGet && req.URL.Path == "/admin/clients":
+		list := []map[string]interface{}{}
+		for _, c := range s.clients {
+			list = append(list, c)
+		}
+		json.NewEncoder(w).Encode(list)
+	case req.Method == http.MethodPost:
+		var c map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&c)
+		if _, ok := s.clients[c["client_id"].(string)]; ok {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		s.clients[c["client_id"].(string)] = c
+		w.WriteHeader(http.StatusCreated)
+	case s.clients[id] == nil:
+		w.WriteHeader(http.StatusNotFound)
+	case req.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(s.clients[id])
+	case req.Method == http.MethodPut:
+		var c map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&c)
+		s.clients[id] = c
+		json.NewEncoder(w).Encode(c)
+	case req.Method == http.MethodDelete:
+		delete(s.clients, id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestHydraBackend(t *testing.T) {
+	stub := &hydraStub{clients: map[string]map[string]interface{}{
+		// Owned by someone else, with metadata that isn't a string map
+		"other": {
+			"client_id":     "other",
+			"redirect_uris": []interface{}{"https://other/cb"},
+			"metadata":      map[string]interface{}{"owner": map[string]interface{}{"team": "a"}, "tier": 1},
+		},
+	}}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	b, err := newHydraBackend(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := b.Health(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &staticClient{Id: "app", Public: true, RedirectURIs: []string{"https://app/cb"}}
+	if err := b.Ensure(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	if got := stub.clients["app"]["token_endpoint_auth_method"]; got != "none" {
+		t.Errorf("expected auth method none for a public client, got %v", got)
+	}
+
+	// Updated in place, keeping other metadata
+	stub.clients["app"]["metadata"].(map[string]interface{})["note"] = []interface{}{"kept"}
+	client.RedirectURIs = append(client.RedirectURIs, "https://app2/cb")
+	stub.requests = nil
+	if err := b.Ensure(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(stub.requests, ","); got != "GET,PUT" {
+		t.Errorf("expected the client to be read and updated, got %s", got)
+	}
+	if got := stub.clients["app"]["redirect_uris"].([]interface{}); len(got) != 2 {
+		t.Errorf("client not updated, redirect uris %v", got)
+	}
+	if _, ok := stub.clients["app"]["metadata"].(map[string]interface{})["note"]; !ok {
+		t.Error("metadata of the client dropped on update")
+	}
+
+	// Clients managed by someone else are left alone
+	if err := b.Ensure(ctx, &staticClient{Id: "other", RedirectURIs: []string{"https://mine/cb"}}); !errors.Is(err, errUnmanagedClient) {
+		t.Fatalf("expected an unmanaged client error, got %v", err)
+	}
+	if err := b.Delete(ctx, &staticClient{Id: "other"}); !errors.Is(err, errUnmanagedClient) {
+		t.Fatalf("expected an unmanaged client error, got %v", err)
+	}
+	if got := stub.clients["other"]; got == nil || got["redirect_uris"].([]interface{})[0] != "https://other/cb" {
+		t.Errorf("unmanaged client changed: %v", got)
+	}
+
+	list, err := b.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Id != "app" || !list[0].Public {
+		t.Errorf("expected only the managed client, got %v", list)
+	}
+
+	if err := b.Delete(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	// Deleting a missing client isn't an error
+	if err := b.Delete(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stub.clients["app"]; ok {
+		t.Error("client not deleted")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	netv1 "k8s.io/api/networking/v1"
+	netv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Legacy annotation giving the class of an Ingress
+const AnnotationIngressClass = "kubernetes.io/ingress.class"
+
+// Restricts the Ingresses defining clients to some IngressClasses
+type ingressClassFilter struct {
+	// Allowed classes, all if empty
+	classes map[string]bool
+	// IngressClasses, to find the default one
+	store cache.Store
+}
+
+// Return a new filter allowing the given classes, or all if none
+func newIngressClassFilter(classes []string) *ingressClassFilter {
+	f := &ingressClassFilter{
+		classes: make(map[string]bool),
+	}
+	for _, class := range classes {
+		f.classes[class] = true
+	}
+	return f
+}
+
+// Return whether Ingresses are filtered on their class
+func (f *ingressClassFilter) enabled() bool {
+	return len(f.classes) > 0
+}
+
+// Return the name of the default IngressClass, or "" if there is none or more
+// than one
+func (f *ingressClassFilter) defaultClass() string {
+	if f.store == nil {
+		return ""
+	}
+	var names []string
+	for _, obj := range f.store.List() {
+		if o, ok := obj.(metav1.Object); ok && isDefaultIngressClass(o) {
+			names = append(names, o.GetName())
+		}
+	}
+	if len(names) != 1 {
+		return ""
+	}
+	return names[0]
+}
+
+// Return whether an IngressClass is marked as the default one
+func isDefaultIngressClass(o metav1.Object) bool {
+	return strings.EqualFold(o.GetAnnotations()[netv1.AnnotationIsDefaultIngressClass], "true")
+}
+
+// Return the class of an Ingress, from spec.ingressClassName or the legacy
+// annotation. Ingresses without either get the default IngressClass
+func (f *ingressClassFilter) classOf(obj interface{}) string {
+	var (
+		o         metav1.Object
+		className *string
+	)
+	switch obj := obj.(type) {
+	case *extv1beta1.Ingress:
+		o, className = obj, obj.Spec.IngressClassName
+	case *netv1beta1.Ingress:
+		o, className = obj, obj.Spec.IngressClassName
+	case *netv1.Ingress:
+		o, className = obj, obj.Spec.IngressClassName
+	default:
+		return ""
+	}
+
+	if className != nil && *className != "" {
+		return *className
+	}
+	if class, ok := o.GetAnnotations()[AnnotationIngressClass]; ok && class != "" {
+		return class
+	}
+	return f.defaultClass()
+}
+
+// Return whether the clients of an Ingress should be registered
+func (f *ingressClassFilter) allows(obj interface{}) bool {
+	if !f.enabled() {
+		return true
+	}
+	return f.classes[f.classOf(obj)]
+}
+
+// Resource handler syncing Ingresses again when the default IngressClass changes
+type IngressClassClient struct {
+	sources *namespaceSources
+}
+
+func NewIngressClassClient(sources *namespaceSources) *IngressClassClient {
+	return &IngressClassClient{
+		sources: sources,
+	}
+}
+
+// Hand all Ingresses to their handlers again
+func (c *IngressClassClient) resyncIngresses() {
+	c.sources.resyncMatching(func(o metav1.Object) bool {
+		switch o.(type) {
+		case *extv1beta1.Ingress, *netv1beta1.Ingress, *netv1.Ingress:
+			return true
+		}
+		return false
+	})
+}
+
+// Handle IngressClass creation
+func (c *IngressClassClient) OnAdd(obj interface{}) {
+	if o, ok := obj.(metav1.Object); ok && isDefaultIngressClass(o) {
+		log.Infof("Default IngressClass '%s' added, syncing Ingresses", o.GetName())
+		c.resyncIngresses()
+	}
+}
+
+// Handle IngressClass update
+func (c *IngressClassClient) OnUpdate(oldObj, newObj interface{}) {
+	oldO, ok := oldObj.(metav1.Object)
+	newO, ok2 := newObj.(metav1.Object)
+	if !ok || !ok2 || isDefaultIngressClass(oldO) == isDefaultIngressClass(newO) {
+		return
+	}
+	log.Infof("Default IngressClass changed to or from '%s', syncing Ingresses", newO.GetName())
+	c.resyncIngresses()
+}
+
+// Handle IngressClass deletion
+func (c *IngressClassClient) OnDelete(obj interface{}) {
+	if o, ok := deletedObject(obj).(metav1.Object); ok && isDefaultIngressClass(o) {
+		log.Infof("Default IngressClass '%s' deleted, syncing Ingresses", o.GetName())
+		c.resyncIngresses()
+	}
+}
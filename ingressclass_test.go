@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	netv1 "k8s.io/api/networking/v1"
+	netv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestIngressClassFilter(t *testing.T) {
+	className := func(name string) *string { return &name }
+	legacy := func(class string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: "app", Annotations: map[string]string{AnnotationIngressClass: class}}
+	}
+
+	tests := []struct {
+		name    string
+		classes []string
+		// IngressClasses marked as the default one
+		defaults []string
+		ingress  interface{}
+		// Class the Ingress resolves to
+		class   string
+		allowed bool
+	}{
+		{
+			name:    "no filter",
+			ingress: &netv1.Ingress{Spec: netv1.IngressSpec{IngressClassName: className("nginx-internal")}},
+			class:   "nginx-internal",
+			allowed: true,
+		},
+		{
+			name:    "ingress class name",
+			classes: []string{"nginx-external"},
+			ingress: &netv1.Ingress{Spec: netv1.IngressSpec{IngressClassName: className("nginx-external")}},
+			class:   "nginx-external",
+			allowed: true,
+		},
+		{
+			name:    "other ingress class name",
+			classes: []string{"nginx-external"},
+			ingress: &netv1.Ingress{Spec: netv1.IngressSpec{IngressClassName: className("nginx-internal")}},
+			class:   "nginx-internal",
+		},
+		{
+			name:    "legacy annotation",
+			classes: []string{"nginx-external"},
+			ingress: &extv1beta1.Ingress{ObjectMeta: legacy("nginx-external")},
+			class:   "nginx-external",
+			allowed: true,
+		},
+		{
+			name:    "class name wins over the annotation",
+			classes: []string{"nginx-external"},
+			ingress: &netv1beta1.Ingress{
+				ObjectMeta: legacy("nginx-external"),
+				Spec:       netv1beta1.IngressSpec{IngressClassName: className("nginx-internal")},
+			},
+			class: "nginx-internal",
+		},
+		{
+			name:     "default class",
+			classes:  []string{"nginx-external"},
+			defaults: []string{"nginx-external"},
+			ingress:  &netv1.Ingress{},
+			class:    "nginx-external",
+			allowed:  true,
+		},
+		{
+			name:     "explicit class over the default one",
+			classes:  []string{"nginx-external"},
+			defaults: []string{"nginx-external"},
+			ingress:  &netv1.Ingress{ObjectMeta: legacy("nginx-internal")},
+			class:    "nginx-internal",
+		},
+		{
+			name:    "no default class",
+			classes: []string{"nginx-external"},
+			ingress: &netv1.Ingress{},
+		},
+		{
+			name:     "several default classes",
+			classes:  []string{"nginx-external"},
+			defaults: []string{"nginx-external", "nginx-internal"},
+			ingress:  &netv1.Ingress{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newIngressClassFilter(tt.classes)
+			f.store = cache.NewStore(cache.MetaNamespaceKeyFunc)
+			for _, name := range []string{"nginx-external", "nginx-internal"} {
+				class := &netv1.IngressClass{ObjectMeta: metav1.ObjectMeta{Name: name}}
+				for _, d := range tt.defaults {
+					if d == name {
+						class.Annotations = map[string]string{netv1.AnnotationIsDefaultIngressClass: "True"}
+					}
+				}
+				if err := f.store.Add(class); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if class := f.classOf(tt.ingress); class != tt.class {
+				t.Errorf("expected class %q, got %q", tt.class, class)
+			}
+			if allowed := f.allows(tt.ingress); allowed != tt.allowed {
+				t.Errorf("expected allowed %v, got %v", tt.allowed, allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/base32"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	BackendKubernetes = "kubernetes"
+
+	// Label marking the Dex objects managed by the watcher
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	ManagedByValue = "dex-k8s-ingress-watcher"
+)
+
+// Dex clients, as stored by Dex's kubernetes storage
+var OAuth2ClientResource = schema.GroupVersionResource{Group: "dex.coreos.com", Version: "v1", Resource: "oauth2clients"}
+
+// Encoding of the object names of Dex's kubernetes storage
+var dexNameEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567")
+
+// Backend writing the clients as the OAuth2Client objects of Dex's kubernetes
+// storage, without going through Dex's gRPC API. Objects not labelled as managed
+// by the watcher are left alone
+type kubernetesBackend struct {
+	client    dynamic.Interface
+	namespace string
+}
+
+// Return a new backend writing clients in the given namespace, the one Dex's
+// kubernetes storage uses
+func newKubernetesBackend(client dynamic.Interface, namespace string) *kubernetesBackend {
+	return &kubernetesBackend{
+		client:    client,
+		namespace: namespace,
+	}
+}
+
+// Return the name Dex gives the object of a client
+func dexObjectName(id string) string {
+	return strings.TrimRight(dexNameEncoding.EncodeToString(fnv.New64().Sum([]byte(id))), "=")
+}
+
+func (b *kubernetesBackend) resource() dynamic.ResourceInterface {
+	return b.client.Resource(OAuth2ClientResource).Namespace(b.namespace)
+}
+
+// Return whether an object is managed by the watcher
+func isManaged(o *unstructured.Unstructured) bool {
+	return o.GetLabels()[ManagedByLabel] == ManagedByValue
+}
+
+func (b *kubernetesBackend) Ensure(ctx context.Context, client *staticClient) error {
+	name := dexObjectName(client.Id)
+	o, err := b.resource().Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		o = &unstructured.Unstructured{}
+		o.SetAPIVersion(OAuth2ClientResource.GroupVersion().String())
+		o.SetKind("OAuth2Client")
+		o.SetName(name)
+		o.SetNamespace(b.namespace)
+		o.SetLabels(map[string]string{ManagedByLabel: ManagedByValue})
+		setOAuth2Client(o, client)
+		if _, err := b.resource().Create(ctx, o, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("Dex storage: failed to create client '%s': %s", client.Id, err)
+		}
+		log.Infof("Dex storage: Successfully created client '%s'", client.Id)
+		return nil
+	case err != nil:
+		return fmt.Errorf("Dex storage: failed to read client '%s': %s", client.Id, err)
+	case !isManaged(o):
+		return fmt.Errorf("Dex storage: client '%s' %w", client.Id, errUnmanagedClient)
+	}
+
+	setOAuth2Client(o, client)
+	if _, err := b.resource().Update(ctx, o, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("Dex storage: failed to update client '%s': %s", client.Id, err)
+	}
+	log.Infof("Dex storage: Successfully updated client '%s'", client.Id)
+	return nil
+}
+
+func (b *kubernetesBackend) Delete(ctx context.Context, client *staticClient) error {
+	name := dexObjectName(client.Id)
+	o, err := b.resource().Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		log.Warnf("Dex storage: client '%s' could not be deleted - not found", client.Id)
+		return nil
+	case err != nil:
+		return fmt.Errorf("Dex storage: failed to read client '%s': %s", client.Id, err)
+	case !isManaged(o):
+		return fmt.Errorf("Dex storage: client '%s' %w", client.Id, errUnmanagedClient)
+	}
+
+	// Only delete the object read, in case it was replaced since
+	uid := o.GetUID()
+	err = b.resource().Delete(ctx, name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &uid},
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("Dex storage: failed to delete client '%s': %s", client.Id, err)
+	}
+	log.Infof("Dex storage: Successfully deleted client '%s'", client.Id)
+	return nil
+}
+
+func (b *kubernetesBackend) Get(ctx context.Context, id string) (*staticClient, error) {
+	o, err := b.resource().Get(ctx, dexObjectName(id), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return getOAuth2Client(o), nil
+}
+
+// Return the clients managed by the watcher
+func (b *kubernetesBackend) List(ctx context.Context) ([]*staticClient, error) {
+	list, err := b.resource().List(ctx, metav1.ListOptions{LabelSelector: ManagedByLabel + "=" + ManagedByValue})
+	if err != nil {
+		return nil, err
+	}
+
+	clients := make([]*staticClient, 0, len(list.Items))
+	for i := range list.Items {
+		clients = append(clients, getOAuth2Client(&list.Items[i]))
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Id < clients[j].Id
+	})
+	return clients, nil
+}
+
+func (b *kubernetesBackend) Health(ctx context.Context) error {
+	_, err := b.resource().List(ctx, metav1.ListOptions{Limit: 1})
+	return err
+}
+
+// Set the fields of an OAuth2Client object from a client
+func setOAuth2Client(o *unstructured.Unstructured, client *staticClient) {
+	o.Object["id"] = client.Id
+	o.Object["secret"] = client.Secret
+	o.Object["redirectURIs"] = toInterfaces(client.RedirectURIs)
+	o.Object["trustedPeers"] = toInterfaces(client.TrustedPeers)
+	o.Object["public"] = client.Public
+	o.Object["name"] = client.Name
+	o.Object["logoURL"] = client.LogoURL
+}
+
+// Return the client of an OAuth2Client object
+func getOAuth2Client(o *unstructured.Unstructured) *staticClient {
+	client := &staticClient{}
+	client.Id, _, _ = unstructured.NestedString(o.Object, "id")
+	client.Secret, _, _ = unstructured.NestedString(o.Object, "secret")
+	client.RedirectURIs, _, _ = unstructured.NestedStringSlice(o.Object, "redirectURIs")
+	client.TrustedPeers, _, _ = unstructured.NestedStringSlice(o.Object, "trustedPeers")
+	client.Public, _, _ = unstructured.NestedBool(o.Object, "public")
+	client.Name, _, _ = unstructured.NestedString(o.Object, "name")
+	client.LogoURL, _, _ = unstructured.NestedString(o.Object, "logoURL")
+	return client
+}
+
+// Return a list of strings as unstructured content
+func toInterfaces(values []string) []interface{} {
+	list := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		list = append(list, v)
+	}
+	return list
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+// Return a backend over a fake client holding the given objects
+func newTestKubernetesBackend(objects ...runtime.Object) (*kubernetesBackend, *dynamicfake.FakeDynamicClient) {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{OAuth2ClientResource: "OAuth2ClientList"}, objects...)
+	return newKubernetesBackend(client, "kube-auth"), client
+}
+
+func TestDexObjectName(t *testing.T) {
+	// Names of the clients checked by hack/test-kind-dex.sh
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{id: "ingress-kube-auth", want: "nfxgo4tfonzs223vmjss2ylvorumx4u44scceizf"},
+		{id: "ingress-kube-auth-multi-uri", want: "nfxgo4tfonzs223vmjss2ylvoruc23lvnr2gsllvoju4x4u44scceizf"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			if name := dexObjectName(tt.id); name != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, name)
+			}
+		})
+	}
+}
+
+func TestKubernetesBackend(t *testing.T) {
+	ctx := context.Background()
+	b, client := newTestKubernetesBackend()
+
+	app := &staticClient{
+		Id:           "app",
+		Name:         "App",
+		Secret:       "secret",
+		RedirectURIs: []string{"https://app.example.com/callback"},
+		TrustedPeers: []string{"cli"},
+		LogoURL:      "https://example.com/logo.png",
+	}
+	if err := b.Ensure(ctx, app); err != nil {
+		t.Fatal(err)
+	}
+	o, err := client.Resource(OAuth2ClientResource).Namespace("kube-auth").Get(ctx, dexObjectName("app"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.GetKind() != "OAuth2Client" || !isManaged(o) {
+		t.Errorf("expected a managed OAuth2Client, got kind %s with labels %v", o.GetKind(), o.GetLabels())
+	}
+	if got, err := b.Get(ctx, "app"); err != nil || !reflect.DeepEqual(got, app) {
+		t.Errorf("expected %+v, got %+v (%v)", app, got, err)
+	}
+
+	// Updated in place
+	updated := &staticClient{Id: "app", Secret: "secret", RedirectURIs: []string{"https://app.example.com/login"}, Public: true}
+	if err := b.Ensure(ctx, updated); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := b.Get(ctx, "app"); err != nil || !reflect.DeepEqual(got, &staticClient{
+		Id:           "app",
+		Secret:       "secret",
+		RedirectURIs: []string{"https://app.example.com/login"},
+		TrustedPeers: []string{},
+		Public:       true,
+	}) {
+		t.Errorf("expected the updated client, got %+v (%v)", got, err)
+	}
+
+	if err := b.Ensure(ctx, testClient("other", "https://other.example.com/callback")); err != nil {
+		t.Fatal(err)
+	}
+	list, err := b.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Id != "app" || list[1].Id != "other" {
+		t.Errorf("expected clients app and other, got %+v", list)
+	}
+
+	if err := b.Delete(ctx, app); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := b.Get(ctx, "app"); err != nil || got != nil {
+		t.Errorf("expected client app to be deleted, got %+v (%v)", got, err)
+	}
+	// Already gone
+	if err := b.Delete(ctx, app); err != nil {
+		t.Errorf("expected a missing client to be ignored, got %v", err)
+	}
+}
+
+func TestKubernetesBackendUnmanaged(t *testing.T) {
+	ctx := context.Background()
+
+	// Written by Dex itself, or by hand
+	o := &unstructured.Unstructured{}
+	o.SetAPIVersion(OAuth2ClientResource.GroupVersion().String())
+	o.SetKind("OAuth2Client")
+	o.SetName(dexObjectName("app"))
+	o.SetNamespace("kube-auth")
+	setOAuth2Client(o, testClient("app", "https://dex.example.com/callback"))
+	b, _ := newTestKubernetesBackend(o)
+
+	if err := b.Ensure(ctx, testClient("app", "https://app.example.com/callback")); !errors.Is(err, errUnmanagedClient) {
+		t.Errorf("expected Ensure to fail with %v, got %v", errUnmanagedClient, err)
+	}
+	if err := b.Delete(ctx, testClient("app")); !errors.Is(err, errUnmanagedClient) {
+		t.Errorf("expected Delete to fail with %v, got %v", errUnmanagedClient, err)
+	}
+
+	got, err := b.Get(ctx, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.RedirectURIs, []string{"https://dex.example.com/callback"}) {
+		t.Errorf("expected the unmanaged client to be left alone, got %+v", got)
+	}
+	if list, err := b.List(ctx); err != nil || len(list) != 0 {
+		t.Errorf("expected no managed clients, got %+v (%v)", list, err)
+	}
+}
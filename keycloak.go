@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	BackendKeycloak = "keycloak"
+
+	// Client attribute marking the Keycloak clients managed by the watcher
+	KeycloakManagedAttribute = "dex-k8s-ingress-watcher.managed"
+)
+
+// Keycloak client, as represented by the admin REST API. Only the fields the
+// watcher sets are listed, the others are kept on update
+type keycloakClient struct {
+	ID                  string            `json:"id,omitempty"`
+	ClientID            string            `json:"clientId"`
+	Name                string            `json:"name,omitempty"`
+	Protocol            string            `json:"protocol,omitempty"`
+	Enabled             bool              `json:"enabled"`
+	PublicClient        bool              `json:"publicClient"`
+	StandardFlowEnabled bool              `json:"standardFlowEnabled"`
+	Secret              string            `json:"secret,omitempty"`
+	RedirectURIs        []string          `json:"redirectUris"`
+	Attributes          map[string]string `json:"attributes,omitempty"`
+}
+
+// Backend registering the clients as OpenID Connect clients of a Keycloak realm,
+// through the admin REST API. The watcher authenticates with the client
+// credentials of a service-account client, which needs the manage-clients role
+// of the realm. Clients not created by the watcher are left alone
+type keycloakBackend struct {
+	url          string
+	realm        string
+	clientID     string
+	clientSecret string
+	httpClient   *http.Client
+
+	mu sync.Mutex
+	// Access token, and when it expires
+	token   string
+	expires time.Time
+}
+
+// Return a new backend for a realm of the Keycloak at the given URL
+func newKeycloakBackend(keycloakURL string, realm string, clientID string, clientSecret string) (*keycloakBackend, error) {
+	if keycloakURL == "" || realm == "" || clientID == "" || clientSecret == "" {
+		return nil, fmt.Errorf("the keycloak backend needs --keycloak-url, --keycloak-realm, --keycloak-client-id and --keycloak-client-secret")
+	}
+	return &keycloakBackend{
+		url:          strings.TrimRight(keycloakURL, "/"),
+		realm:        realm,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (b *keycloakBackend) Ensure(ctx context.Context, client *staticClient) error {
+	existing, err := b.find(ctx, client.Id)
+	if err != nil {
+		return err
+	}
+
+	kc := &keycloakClient{
+		ClientID:            client.Id,
+		Name:                client.Name,
+		Protocol:            "openid-connect",
+		Enabled:             true,
+		PublicClient:        client.Public,
+		StandardFlowEnabled: true,
+		Secret:              client.Secret,
+		RedirectURIs:        client.RedirectURIs,
+		Attributes:          map[string]string{KeycloakManagedAttribute: "true"},
+	}
+	if client.LogoURL != "" {
+		kc.Attributes["logoUri"] = client.LogoURL
+	}
+
+	if existing == nil {
+		if err := b.do(ctx, http.MethodPost, b.clientsPath(), kc, nil); err != nil {
+			return fmt.Errorf("Keycloak: failed to create client '%s': %s", client.Id, err)
+		}
+		log.Infof("Keycloak: Successfully created client '%s'", client.Id)
+		return nil
+	}
+	if existing.Attributes[KeycloakManagedAttribute] != "true" {
+		return fmt.Errorf("Keycloak: client '%s' %w", client.Id, errUnmanagedClient)
+	}
+
+	kc.ID = existing.ID
+	for k, v := range existing.Attributes {
+		if _, ok := kc.Attributes[k]; !ok && k != "logoUri" {
+			kc.Attributes[k] = v
+		}
+	}
+	if err := b.do(ctx, http.MethodPut, b.clientsPath()+"/"+url.PathEscape(existing.ID), kc, nil); err != nil {
+		return fmt.Errorf("Keycloak: failed to update client '%s': %s", client.Id, err)
+	}
+	log.Infof("Keycloak: Successfully updated client '%s'", client.Id)
+	return nil
+}
+
+func (b *keycloakBackend) Delete(ctx context.Context, client *staticClient) error {
+	existing, err := b.find(ctx, client.Id)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		log.Warnf("Keycloak: client '%s' could not be deleted - not found", client.Id)
+		return nil
+	}
+	if existing.Attributes[KeycloakManagedAttribute] != "true" {
+		return fmt.Errorf("Keycloak: client '%s' %w", client.Id, errUnmanagedClient)
+	}
+
+	if err := b.do(ctx, http.MethodDelete, b.clientsPath()+"/"+url.PathEscape(existing.ID), nil, nil); err != nil {
+		return fmt.Errorf("Keycloak: failed to delete client '%s': %s", client.Id, err)
+	}
+	log.Infof("Keycloak: Successfully deleted client '%s'", client.Id)
+	return nil
+}
+
+func (b *keycloakBackend) Get(ctx context.Context, id string) (*staticClient, error) {
+	existing, err := b.find(ctx, id)
+	if err != nil || existing == nil {
+		return nil, err
+	}
+	return existing.staticClient(), nil
+}
+
+// Return the clients managed by the watcher
+func (b *keycloakBackend) List(ctx context.Context) ([]*staticClient, error) {
+	var kcs []*keycloakClient
+	if err := b.do(ctx, http.MethodGet, b.clientsPath(), nil, &kcs); err != nil {
+		return nil, fmt.Errorf("Keycloak: failed to list clients: %s", err)
+	}
+
+	var clients []*staticClient
+	for _, kc := range kcs {
+		if kc.Attributes[KeycloakManagedAttribute] == "true" {
+			clients = append(clients, kc.staticClient())
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Id < clients[j].Id
+	})
+	return clients, nil
+}
+
+func (b *keycloakBackend) Health(ctx context.Context) error {
+	_, err := b.accessToken(ctx)
+	return err
+}
+
+// Return the client with a client id, or nil if there is none
+func (b *keycloakBackend) find(ctx context.Context, id string) (*keycloakClient, error) {
+	var kcs []*keycloakClient
+	if err := b.do(ctx, http.MethodGet, b.clientsPath()+"?clientId="+url.QueryEscape(id), nil, &kcs); err != nil {
+		return nil, fmt.Errorf("Keycloak: failed to read client '%s': %s", id, err)
+	}
+	for _, kc := range kcs {
+		if kc.ClientID == id {
+			return kc, nil
+		}
+	}
+	return nil, nil
+}
+
+// Return the client, as the watcher sees it
+func (kc *keycloakClient) staticClient() *staticClient {
+	return &staticClient{
+		Id:           kc.ClientID,
+		Name:         kc.Name,
+		Secret:       kc.Secret,
+		RedirectURIs: kc.RedirectURIs,
+		Public:       kc.PublicClient,
+		LogoURL:      kc.Attributes["logoUri"],
+	}
+}
+
+// Path of the clients of the realm
+func (b *keycloakBackend) clientsPath() string {
+	return "/admin/realms/" + url.PathEscape(b.realm) + "/clients"
+}
+
+// Call the admin REST API, sending in and decoding the response into out, if not nil
+func (b *keycloakBackend) do(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	token, err := b.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, b.url+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Return an access token for the admin REST API, getting a new one with the
+// client credentials when the current one is about to expire
+func (b *keycloakBackend) accessToken(ctx context.Context) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.token != "" && time.Now().Before(b.expires) {
+		return b.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {b.clientID},
+		"client_secret": {b.clientSecret},
+	}
+	tokenURL := b.url + "/realms/" + url.PathEscape(b.realm) + "/protocol/openid-connect/token"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Keycloak: failed to get a token: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Keycloak: failed to get a token: %s", resp.Status)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("Keycloak: failed to get a token: %s", err)
+	}
+
+	b.token = token.AccessToken
+	// Renewed a little before it expires, short lived tokens halfway
+	lifetime := time.Duration(token.ExpiresIn) * time.Second
+	margin := 30 * time.Second
+	if lifetime < 2*margin {
+		margin = lifetime / 2
+	}
+	b.expires = time.Now().Add(lifetime - margin)
+	return b.token, nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Stub of Keycloak's token endpoint and admin API for realm "apps"
+type keycloakStub struct {
+	mu sync.Mutex
+	// Lifetime of the tokens handed out, in seconds
+	expiresIn int
+	// Tokens handed out
+	tokens int
+	// Status returned by client writes, if set
+	failWrites int
+	clients    map[string]*keycloakClient
+	nextID     int
+}
+
+func (s *keycloakStub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	const clients = "/admin/realms/apps/clients"
+	if req.URL.Path == "/realms/apps/protocol/openid-connect/token" {
+		if err := req.ParseForm(); err != nil || req.Form.Get("grant_type") != "client_credentials" ||
+			req.Form.Get("client_id") != "watcher" || req.Form.Get("client_secret") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		s.tokens++
+		fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":%d}`, s.tokens, s.expiresIn)
+		return
+	}
+	if req.Header.Get("Authorization") != fmt.Sprintf("Bearer token-%d", s.tokens) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if s.failWrites != 0 && req.Method != http.MethodGet {
+		w.WriteHeader(s.failWrites)
+		w.Write([]byte(`{"error":"unknown_error"}`))
+		return
+	}
+
+	id := strings.TrimPrefix(req.URL.Path, clients+"/")
+	switch {
+	case req.Method == http.MethodGet && req.URL.Path == clients:
+		list := []*keycloakClient{}
+		for _, c := range s.clients {
+			if clientID := req.URL.Query().Get("clientId"); clientID == "" || c.ClientID == clientID {
+				list = append(list, c)
+			}
+		}
+		json.NewEncoder(w).Encode(list)
+	case req.Method == http.MethodPost && req.URL.Path == clients:
+		c := &keycloakClient{}
+		json.NewDecoder(req.Body).Decode(c)
+		s.nextID++
+		c.ID = fmt.Sprintf("uuid-%d", s.nextID)
+		s.clients[c.ID] = c
+		w.WriteHeader(http.StatusCreated)
+	case s.clients[id] == nil:
+		w.WriteHeader(http.StatusNotFound)
+	case req.Method == http.MethodPut:
+		c := &keycloakClient{}
+		json.NewDecoder(req.Body).Decode(c)
+		s.clients[id] = c
+		w.WriteHeader(http.StatusNoContent)
+	case req.Method == http.MethodDelete:
+		delete(s.clients, id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Return the stub client with a client id
+func (s *keycloakStub) client(clientID string) *keycloakClient {
+	for _, c := range s.clients {
+		if c.ClientID == clientID {
+			return c
+		}
+	}
+	return nil
+}
+
+func newTestKeycloak(t *testing.T, expiresIn int) (*keycloakBackend, *keycloakStub) {
+	stub := &keycloakStub{expiresIn: expiresIn, clients: make(map[string]*keycloakClient)}
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+
+	b, err := newKeycloakBackend(server.URL+"/", "apps", "watcher", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, stub
+}
+
+func TestKeycloakToken(t *testing.T) {
+	for _, expiresIn := range []int{300, 20} {
+		t.Run(fmt.Sprintf("expires in %ds", expiresIn), func(t *testing.T) {
+			b, stub := newTestKeycloak(t, expiresIn)
+			ctx := context.Background()
+
+			for i := 0; i < 3; i++ {
+				if err := b.Health(ctx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if stub.tokens != 1 {
+				t.Errorf("expected the token to be reused, got %d tokens", stub.tokens)
+			}
+
+			// Renewed once expired
+			b.expires = time.Now().Add(-time.Second)
+			if _, err := b.List(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if stub.tokens != 2 {
+				t.Errorf("expected a new token, got %d tokens", stub.tokens)
+			}
+		})
+	}
+
+	b, _ := newTestKeycloak(t, 300)
+	b.clientSecret = "wrong"
+	if err := b.Health(context.Background()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected an unauthorized error, got %v", err)
+	}
+}
+
+func TestKeycloakBackend(t *testing.T) {
+	b, stub := newTestKeycloak(t, 300)
+	ctx := context.Background()
+
+	client := &staticClient{
+		Id:           "app",
+		Name:         "App",
+		Secret:       "app-secret",
+		RedirectURIs: []string{"https://app.example.com/callback"},
+		LogoURL:      "https://app.example.com/logo.png",
+	}
+	if err := b.Ensure(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	created := stub.client("app")
+	if created == nil || created.Secret != "app-secret" || created.Name != "App" || created.PublicClient ||
+		created.Protocol != "openid-connect" || created.Attributes["logoUri"] != client.LogoURL ||
+		created.Attributes[KeycloakManagedAttribute] != "true" {
+		t.Fatalf("unexpected client created: %+v", created)
+	}
+
+	client.RedirectURIs = append(client.RedirectURIs, "https://app2.example.com/callback")
+	client.Public = true
+	if err := b.Ensure(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	updated := stub.client("app")
+	if updated.ID != created.ID || len(updated.RedirectURIs) != 2 || !updated.PublicClient {
+		t.Fatalf("client not updated in place: %+v", updated)
+	}
+
+	got, err := b.Get(ctx, "app")
+	if err != nil || got == nil || len(got.RedirectURIs) != 2 {
+		t.Fatalf("unexpected client read: %+v, %v", got, err)
+	}
+
+	if err := b.Delete(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	if stub.client("app") != nil {
+		t.Error("client not deleted")
+	}
+	// Deleting a missing client isn't an error
+	if err := b.Delete(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeycloakUnmanaged(t *testing.T) {
+	b, stub := newTestKeycloak(t, 300)
+	ctx := context.Background()
+	stub.clients["uuid-other"] = &keycloakClient{
+		ID:           "uuid-other",
+		ClientID:     "other",
+		RedirectURIs: []string{"https://other.example.com/callback"},
+	}
+
+	if err := b.Ensure(ctx, &staticClient{Id: "other", RedirectURIs: []string{"https://mine.example.com/callback"}}); !errors.Is(err, errUnmanagedClient) {
+		t.Fatalf("expected an unmanaged client error, got %v", err)
+	}
+	if err := b.Delete(ctx, &staticClient{Id: "other"}); !errors.Is(err, errUnmanagedClient) {
+		t.Fatalf("expected an unmanaged client error, got %v", err)
+	}
+	if got := stub.clients["uuid-other"]; got == nil || got.RedirectURIs[0] != "https://other.example.com/callback" {
+		t.Errorf("unmanaged client changed: %+v", got)
+	}
+
+	if err := b.Ensure(ctx, &staticClient{Id: "app", RedirectURIs: []string{"https://app.example.com/callback"}}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := b.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Id != "app" {
+		t.Errorf("expected only the managed client, got %+v", list)
+	}
+}
+
+func TestKeycloakErrors(t *testing.T) {
+	b, stub := newTestKeycloak(t, 300)
+	ctx := context.Background()
+	client := &staticClient{Id: "app", RedirectURIs: []string{"https://app.example.com/callback"}}
+
+	stub.failWrites = http.StatusForbidden
+	err := b.Ensure(ctx, client)
+	if err == nil || !strings.Contains(err.Error(), "403") || !strings.Contains(err.Error(), "unknown_error") {
+		t.Errorf("expected the forbidden status, got %v", err)
+	}
+
+	stub.failWrites = 0
+	if err := b.Ensure(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	stub.failWrites = http.StatusInternalServerError
+	if err := b.Ensure(ctx, client); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("expected the server error on update, got %v", err)
+	}
+	if err := b.Delete(ctx, client); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("expected the server error on delete, got %v", err)
+	}
+}
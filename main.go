@@ -1,29 +1,23 @@
-//
 // An application which watches for Ingresses and configures Dex clients via
 // gRPC dynamically, based on Ingress annotations.
-//
 package main
 
 import (
+	"bytes"
 	"context"
-	"crypto/tls"
-	"crypto/x509"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/alecthomas/kong"
-	"github.com/coreos/dex/api"
 	"github.com/etherlabsio/healthcheck"
 	log "github.com/sirupsen/logrus"
 
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/credentials/insecure"
-
 	v1 "k8s.io/api/core/v1"
 	extv1beta1 "k8s.io/api/extensions/v1beta1"
 	netv1 "k8s.io/api/networking/v1"
@@ -32,172 +26,341 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/yaml"
 )
 
 // App struct, one per time to use as resource handlers
 type IngressClient struct {
-	dexClient api.DexClient
+	reconciler *reconciler
+	classes    *ingressClassFilter
 }
 
 type ConfigMapClient struct {
-	dexClient api.DexClient
+	reconciler *reconciler
+	client     kubernetes.Interface
+
+	mu sync.Mutex
+	// Clients key of the ConfigMaps fetched, by namespace/name
+	data map[string]configMapData
+}
+
+// Clients key of a ConfigMap, at a resource version
+type configMapData struct {
+	resourceVersion string
+	data            string
+	found           bool
 }
 
 type SecretClient struct {
-	dexClient api.DexClient
+	reconciler *reconciler
+	client     kubernetes.Interface
+}
+
+type ServiceClient struct {
+	reconciler *reconciler
+}
+
+// Attributes of a Dex StaticClient, as defined by a resource. Lists of clients
+// use the same format as staticClients in Dex's config
+type staticClient struct {
+	Id           string   `json:"id"`
+	Name         string   `json:"name,omitempty"`
+	Secret       string   `json:"secret,omitempty"`
+	RedirectURIs []string `json:"redirectURIs"`
+	TrustedPeers []string `json:"trustedPeers,omitempty"`
+	Public       bool     `json:"public,omitempty"`
+	LogoURL      string   `json:"logoURL,omitempty"`
+	// Opts in to sharing the client with other resources, which add their
+	// redirect URIs to it. Not part of Dex's format
+	Shared bool `json:"shared,omitempty"`
+	// Names of the Dex endpoints to register the client with, when several
+	// are configured. Not part of Dex's format
+	Endpoints []string `json:"endpoints,omitempty"`
 }
 
 const (
-	// Define annotations we check for in the watched resources
-	AnnotationDexStaticClientId          = "mintel.com/dex-k8s-ingress-watcher-client-id"
-	AnnotationDexStaticClientName        = "mintel.com/dex-k8s-ingress-watcher-client-name"
-	AnnotationDexStaticClientRedirectURI = "mintel.com/dex-k8s-ingress-watcher-redirect-uri"
-	AnnotationDexStaticClientSecret      = "mintel.com/dex-k8s-ingress-watcher-secret"
-	SyncPeriodInMinutes                  = 10
+	// Define annotations we check for in the watched resources, appended to
+	// each of the configured annotation prefixes
+	AnnotationDexStaticClientId          = "-client-id"
+	AnnotationDexStaticClientName        = "-client-name"
+	AnnotationDexStaticClientRedirectURI = "-redirect-uri"
+	AnnotationDexStaticClientSecret      = "-secret"
+	AnnotationDexStaticClientSecretKey   = "-secret-key"
+	AnnotationDexStaticClientLogoURL     = "-logo-url"
+	AnnotationDexStaticClients           = "-clients"
+	AnnotationDexStaticClientShared      = "-shared-client"
+	DefaultAnnotationPrefix              = "mintel.com/dex-k8s-ingress-watcher"
+	DefaultLabelSelector                 = "mintel.com/dex-k8s-ingress-watcher=enabled"
+	// Default ConfigMap data key holding a list of clients
+	DefaultConfigMapClientsKey = "clients.yaml"
+	SyncPeriodInMinutes        = 10
 )
 
-// Label Selector for Configmap and Secret to watch
-// Can't define a CONSTANT map
-var configMapSecretsSelectorLabels = labels.SelectorFromSet(labels.Set(map[string]string{"mintel.com/dex-k8s-ingress-watcher": "enabled"})).String()
+// Label Selector for Configmap and Secret to watch, set by flag
+var configMapSecretsSelectorLabels = DefaultLabelSelector
 
-// Return a new Dex Client to perform gRPC calls with
-func newDexClient(grpcAddress string, caPath string, clientCrtPath string, clientKeyPath string) api.DexClient {
-	if caPath != "" && clientCrtPath != "" && clientKeyPath != "" {
-		cPool := x509.NewCertPool()
+// Annotation prefixes to look for, in order of preference, set by flag
+var annotationPrefixes = []string{DefaultAnnotationPrefix}
 
-		caCert, err := ioutil.ReadFile(caPath)
-		exitOnError(err)
+// Logo shown by Dex for clients without a logo-url annotation, set by flag
+var defaultLogoURL string
 
-		if !cPool.AppendCertsFromPEM(caCert) {
-			log.Errorf("failed to parse CA crt")
-		}
+// ConfigMap data key holding a list of clients, set by flag
+var configMapClientsKey = DefaultConfigMapClientsKey
 
-		clientCert, err := tls.LoadX509KeyPair(clientCrtPath, clientKeyPath)
-		exitOnError(err)
+// Return a new app. One per Type to be used as resource handler
+func NewIngressClient(r *reconciler, classes *ingressClassFilter) *IngressClient {
+	return &IngressClient{
+		reconciler: r,
+		classes:    classes,
+	}
+}
 
-		clientTLSConfig := &tls.Config{
-			RootCAs:      cPool,
-			Certificates: []tls.Certificate{clientCert},
-		}
-		creds := credentials.NewTLS(clientTLSConfig)
-		conn, err := grpc.Dial(grpcAddress, grpc.WithTransportCredentials(creds))
-		exitOnError(err)
-		return api.NewDexClient(conn)
-	} else {
-		conn, err := grpc.Dial(grpcAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
-		exitOnError(err)
-		return api.NewDexClient(conn)
+func NewConfigMapClient(r *reconciler, client kubernetes.Interface) *ConfigMapClient {
+	return &ConfigMapClient{
+		reconciler: r,
+		client:     client,
+		data:       make(map[string]configMapData),
 	}
+}
 
+func NewSecretClient(r *reconciler, client kubernetes.Interface) *SecretClient {
+	return &SecretClient{
+		reconciler: r,
+		client:     client,
+	}
 }
 
-// Add Dex StaticClient via gRPC
-func addDexStaticClient(
-	c api.DexClient,
-	kind string,
-	name string,
-	namespace string,
-	static_client_id string,
-	static_client_name string,
-	static_client_redirect_uri string,
-	static_client_secret string) {
+func NewServiceClient(r *reconciler) *ServiceClient {
+	return &ServiceClient{
+		reconciler: r,
+	}
+}
 
-	log.Infof("Registering %s '%s' with static client '%s' at callback '%s'",
-		kind,
-		name,
-		static_client_id,
-		static_client_redirect_uri)
+// Look up an annotation under any of the configured prefixes, the first
+// prefix having it wins
+func getAnnotation(ann map[string]string, key string) (string, bool) {
+	for _, prefix := range annotationPrefixes {
+		if value, ok := ann[prefix+key]; ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// Full name of an annotation under the preferred prefix
+func annotationName(key string) string {
+	return annotationPrefixes[0] + key
+}
 
-	redirect_uris := strings.Split(static_client_redirect_uri, ",")
+// Split a comma separated list of redirect URIs
+func splitRedirectURIs(redirect_uri string) []string {
+	redirect_uris := strings.Split(redirect_uri, ",")
 	for i := range redirect_uris {
 		redirect_uris[i] = strings.TrimSpace(redirect_uris[i])
 	}
+	return redirect_uris
+}
 
-	req := &api.CreateClientReq{
-		Client: &api.Client{
-			Id:           static_client_id,
-			Name:         static_client_name,
-			Secret:       static_client_secret,
-			RedirectUris: redirect_uris,
-		},
+// Read the single client defined by the client-id, client-name, redirect-uri,
+// secret and logo-url annotations, expanding templates in the name and redirect
+// URIs. Returns nil if there is no client-id annotation
+func extractAnnotations(ann map[string]string, data *templateData) (*staticClient, error) {
+
+	static_client_id, ok := getAnnotation(ann, AnnotationDexStaticClientId)
+	if !ok {
+		return nil, nil
 	}
 
-	resp, err := c.CreateClient(context.TODO(), req)
-	exitOnError(err)
-	if resp.AlreadyExists {
-		log.Warnf("Dex gPRC: client already exists for %s '%s' from namespace '%s'", kind, name, namespace)
-	} else {
-		log.Infof("Dex gRPC: Successfully created client for %s '%s' from namespace '%s'", kind, name, namespace)
+	static_client_name, _ := getAnnotation(ann, AnnotationDexStaticClientName)
+
+	// Can be left to the callback-path default of the namespace
+	var static_client_redirect_uris []string
+	if static_client_redirect_uri, ok := getAnnotation(ann, AnnotationDexStaticClientRedirectURI); ok {
+		static_client_redirect_uris = splitRedirectURIs(static_client_redirect_uri)
 	}
-}
 
-// Delete Dex StaticClient via gRPC
-func deleteDexStaticClient(c api.DexClient, kind string, name string, namespace string, static_client_id string) {
+	static_client_secret, ok := getAnnotation(ann, AnnotationDexStaticClientSecret)
+	if !ok {
+		return nil, fmt.Errorf("missing annotation '%s'", annotationName(AnnotationDexStaticClientSecret))
+	}
 
-	log.Infof("Deleting %s '%s' with static client '%s'", kind, name, static_client_id)
+	static_client_logo_url, _ := getAnnotation(ann, AnnotationDexStaticClientLogoURL)
 
-	req := &api.DeleteClientReq{
-		Id: static_client_id,
+	static_client_shared := false
+	if value, ok := getAnnotation(ann, AnnotationDexStaticClientShared); ok {
+		shared, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid annotation '%s': %s", annotationName(AnnotationDexStaticClientShared), err)
+		}
+		static_client_shared = shared
 	}
 
-	resp, err := c.DeleteClient(context.TODO(), req)
-	exitOnError(err)
-	if resp.NotFound {
-		log.Errorf("Dex gPRC: client '%s' could not be deleted for %s '%s' from namespace '%s' - not found", static_client_id, kind, name, namespace)
-	} else {
-		log.Infof("Dex gRPC: Successfully deleted client for %s '%s' from namespace '%s'", kind, name, namespace)
+	client := &staticClient{
+		Id:           static_client_id,
+		Name:         static_client_name,
+		RedirectURIs: static_client_redirect_uris,
+		Secret:       static_client_secret,
+		LogoURL:      static_client_logo_url,
+		Shared:       static_client_shared,
 	}
+	if err := expandClient(client, data); err != nil {
+		return nil, err
+	}
+	return client, nil
 }
 
-// Return a new app. One per Type to be used as resource handler
-func NewIngressClient(dexClient api.DexClient) *IngressClient {
-	return &IngressClient{
-		dexClient: dexClient,
+// Read all clients defined by the annotations of a resource: the single client
+// annotations, and the JSON list of the clients annotation
+func extractClients(ann map[string]string, data *templateData) ([]*staticClient, error) {
+	var clients []*staticClient
+
+	client, err := extractAnnotations(ann, data)
+	if err != nil {
+		return nil, err
+	}
+	if client != nil {
+		clients = append(clients, client)
 	}
-}
 
-func NewConfigMapClient(dexClient api.DexClient) *ConfigMapClient {
-	return &ConfigMapClient{
-		dexClient: dexClient,
+	if value, ok := getAnnotation(ann, AnnotationDexStaticClients); ok {
+		list, err := parseStaticClients([]byte(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid annotation '%s': %s", annotationName(AnnotationDexStaticClients), err)
+		}
+		if err := expandClients(list, data); err != nil {
+			return nil, err
+		}
+		clients = append(clients, list...)
 	}
+
+	return clients, nil
 }
 
-func NewSecretClient(dexClient api.DexClient) *SecretClient {
-	return &SecretClient{
-		dexClient: dexClient,
+// Parse a JSON or YAML list of clients, in the format of Dex's staticClients.
+// The list can also be given under a staticClients key, as in Dex's config
+func parseStaticClients(data []byte) ([]*staticClient, error) {
+	data, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var doc map[string]json.RawMessage
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		list, ok := doc["staticClients"]
+		if !ok {
+			return nil, fmt.Errorf("expected a list of clients or a staticClients key")
+		}
+		data = list
+	}
+
+	var clients []*staticClient
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// Catches typos, and Dex-only fields such as idEnv and secretEnv
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&clients); err != nil {
+		return nil, err
 	}
+	return clients, nil
 }
 
-func extractAnnotations(ann map[string]string) (client_id string, client_name string, client_redirect_uri string, client_secret string, err error) {
+// Apply defaults to a list of clients and check they are complete and unique
+func completeClients(clients []*staticClient) error {
+	ids := make(map[string]bool)
+	for i, client := range clients {
+		if client == nil || client.Id == "" {
+			return fmt.Errorf("client %d: missing id", i)
+		}
+		if ids[client.Id] {
+			return fmt.Errorf("client '%s': defined more than once", client.Id)
+		}
+		ids[client.Id] = true
 
-	static_client_id, ok := ann[AnnotationDexStaticClientId]
-	if !ok {
-		return "", "", "", "", fmt.Errorf("missing annotation '%s'", AnnotationDexStaticClientId)
+		if client.Secret == "" && !client.Public {
+			return fmt.Errorf("client '%s': missing secret", client.Id)
+		}
+		if len(client.RedirectURIs) == 0 {
+			return fmt.Errorf("client '%s': missing redirect uris", client.Id)
+		}
+		redirectURIs, err := validateRedirectURIs(client.RedirectURIs)
+		if err != nil {
+			return fmt.Errorf("client '%s': %s", client.Id, err)
+		}
+		client.RedirectURIs = redirectURIs
+		if client.Name == "" {
+			// Default to using the ID
+			client.Name = client.Id
+		}
+		if client.LogoURL == "" {
+			client.LogoURL = defaultLogoURL
+		}
 	}
+	return nil
+}
 
-	static_client_name, ok := ann[AnnotationDexStaticClientName]
-	if !ok {
-		// Default to using the ID
-		static_client_name = static_client_id
+// Unwrap objects whose deletion was missed by the watch
+func deletedObject(obj interface{}) interface{} {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj
 	}
+	return obj
+}
 
-	static_client_redirect_uri, ok := ann[AnnotationDexStaticClientRedirectURI]
-	if !ok {
-		return "", "", "", "", fmt.Errorf("missing annotation '%s'", AnnotationDexStaticClientRedirectURI)
+// Hand the clients defined by an object to the reconciler, after applying the
+// defaults of its namespace. Objects with an invalid client are rejected,
+// leaving any clients they defined before as is
+func reconcileObject(r *reconciler, ref objectRef, data *templateData, clients []*staticClient, err error) {
+	ann := data.Annotations
+
+	defaults, nsErr := newNamespaceDefaults(r.namespaceAnnotations(ref.Namespace), ann)
+	if nsErr != nil {
+		r.reject(ref, nsErr)
+		return
+	}
+	if !defaults.Enabled {
+		log.Debugf("Clients disabled for %s '%s' from namespace '%s'", ref.Kind, ref.Name, ref.Namespace)
+		clients, err = nil, nil
 	}
 
-	static_client_secret, ok := ann[AnnotationDexStaticClientSecret]
-	if !ok {
-		return "", "", "", "", fmt.Errorf("missing annotation '%s'", AnnotationDexStaticClientSecret)
+	if err == nil {
+		err = defaults.apply(clients, data.Scheme, data.Hosts)
+	}
+	if err == nil && dexEndpoints != nil {
+		err = dexEndpoints.route(ref.Namespace, clients)
+	}
+	if err == nil {
+		err = completeClients(clients)
+	}
+	if err == nil {
+		err = applyClientIDTemplate(ref, clients)
+	}
+	if err != nil {
+		r.reject(ref, err)
+		return
+	}
+	if len(clients) == 0 {
+		log.Debugf("No clients defined by %s '%s' from namespace '%s'", ref.Kind, ref.Name, ref.Namespace)
 	}
 
-	return static_client_id, static_client_name, static_client_redirect_uri, static_client_secret, nil
+	registered := r.apply(ref, clients)
+	r.publishClientIDs(ref, ann, registered, clientIDTemplate != nil || defaults.ClientIDPrefix != "")
 }
 
 // Handle Client creation on Ingress event
@@ -206,40 +369,83 @@ func (c *IngressClient) OnAdd(obj interface{}) {
 	const kind = "Ingress"
 
 	var (
-		name                       string
-		namespace                  string
-		static_client_id           string
-		static_client_name         string
-		static_client_redirect_uri string
-		static_client_secret       string
-		err                        error
+		o        metav1.Object
+		resource schema.GroupVersionResource
 	)
-	switch o := obj.(type) {
+	switch obj := obj.(type) {
 	case *extv1beta1.Ingress:
-		name, namespace = o.Name, o.Namespace
-		static_client_id, static_client_name, static_client_redirect_uri, static_client_secret, err = extractAnnotations(o.GetAnnotations())
+		o, resource = obj, extv1beta1.SchemeGroupVersion.WithResource("ingresses")
 	case *netv1beta1.Ingress:
-		name, namespace = o.Name, o.Namespace
-		static_client_id, static_client_name, static_client_redirect_uri, static_client_secret, err = extractAnnotations(o.GetAnnotations())
+		o, resource = obj, netv1beta1.SchemeGroupVersion.WithResource("ingresses")
 	case *netv1.Ingress:
-		name, namespace = o.Name, o.Namespace
-		static_client_id, static_client_name, static_client_redirect_uri, static_client_secret, err = extractAnnotations(o.GetAnnotations())
+		o, resource = obj, netv1.SchemeGroupVersion.WithResource("ingresses")
 	default:
 		log.Warnf("Got an unexpected, unsupported, object. Not an Ingress")
 		return
 	}
-	if err != nil {
-		log.Infof("Ignoring %s '%s' from namespace '%s' - %s", kind, name, namespace, err)
+	log.Debugf("Checking %s for clients '%s' from namespace '%s' ...", kind, o.GetName(), o.GetNamespace())
+
+	if !c.classes.allows(obj) {
+		// Also deletes the clients registered before the class changed
+		log.Debugf("Ignoring %s '%s' from namespace '%s' - class '%s' not watched", kind, o.GetName(), o.GetNamespace(), c.classes.classOf(obj))
+		c.reconciler.remove(newObjectRef(kind, resource, o))
 		return
 	}
-	log.Infof("Checking %s for client creation '%s' from namespace '%s' ...", kind, name, namespace)
 
-	addDexStaticClient(c.dexClient, kind, name, namespace, static_client_id, static_client_name, static_client_redirect_uri, static_client_secret)
+	tdata := newTemplateData(kind, o, ingressHosts(obj))
+	clients, err := extractClients(o.GetAnnotations(), tdata)
+	reconcileObject(c.reconciler, newObjectRef(kind, resource, o), tdata, clients, err)
+}
+
+// Return the hosts of an Ingress, from its rules and TLS configuration
+func ingressHosts(obj interface{}) []string {
+	var hosts []string
+	add := func(host string) {
+		if host == "" {
+			return
+		}
+		for _, h := range hosts {
+			if h == host {
+				return
+			}
+		}
+		hosts = append(hosts, host)
+	}
+
+	switch o := obj.(type) {
+	case *extv1beta1.Ingress:
+		for _, rule := range o.Spec.Rules {
+			add(rule.Host)
+		}
+		for _, t := range o.Spec.TLS {
+			for _, host := range t.Hosts {
+				add(host)
+			}
+		}
+	case *netv1beta1.Ingress:
+		for _, rule := range o.Spec.Rules {
+			add(rule.Host)
+		}
+		for _, t := range o.Spec.TLS {
+			for _, host := range t.Hosts {
+				add(host)
+			}
+		}
+	case *netv1.Ingress:
+		for _, rule := range o.Spec.Rules {
+			add(rule.Host)
+		}
+		for _, t := range o.Spec.TLS {
+			for _, host := range t.Hosts {
+				add(host)
+			}
+		}
+	}
+	return hosts
 }
 
 // Handle Ingress update event
 func (c *IngressClient) OnUpdate(oldObj, newObj interface{}) {
-	c.OnDelete(oldObj)
 	c.OnAdd(newObj)
 }
 
@@ -248,59 +454,90 @@ func (c *IngressClient) OnDelete(obj interface{}) {
 	const kind = "Ingress"
 
 	var (
-		name             string
-		namespace        string
-		static_client_id string
-		ok               bool
+		o        metav1.Object
+		resource schema.GroupVersionResource
 	)
-	switch o := obj.(type) {
+	switch obj := deletedObject(obj).(type) {
 	case *extv1beta1.Ingress:
-		name, namespace = o.Name, o.Namespace
-		static_client_id, ok = o.GetAnnotations()[AnnotationDexStaticClientId]
+		o, resource = obj, extv1beta1.SchemeGroupVersion.WithResource("ingresses")
 	case *netv1beta1.Ingress:
-		name, namespace = o.Name, o.Namespace
-		static_client_id, ok = o.GetAnnotations()[AnnotationDexStaticClientId]
+		o, resource = obj, netv1beta1.SchemeGroupVersion.WithResource("ingresses")
 	case *netv1.Ingress:
-		name, namespace = o.Name, o.Namespace
-		static_client_id, ok = o.GetAnnotations()[AnnotationDexStaticClientId]
+		o, resource = obj, netv1.SchemeGroupVersion.WithResource("ingresses")
 	default:
 		log.Warnf("Got an unexpected, unsupported, object. Not an Ingress")
 		return
 	}
-	log.Debugf("Checking %s for client deletion for '%s' from namespace '%s' ...", kind, name, namespace)
-	if !ok {
-		log.Debugf("Ignoring %s '%s' from namespace '%s' - missing %s", kind, name, namespace, AnnotationDexStaticClientId)
-		return
-	}
+	log.Debugf("Checking %s for client deletion for '%s' from namespace '%s' ...", kind, o.GetName(), o.GetNamespace())
 
-	deleteDexStaticClient(c.dexClient, kind, name, namespace, static_client_id)
+	c.reconciler.remove(newObjectRef(kind, resource, o))
 }
 
-// Handle Client creation on ConfigMap event
+// Handle Client creation on ConfigMap event. ConfigMaps are watched by metadata
+// only, the full ConfigMap is fetched when its clients key needs to be read
 func (c *ConfigMapClient) OnAdd(obj interface{}) {
 
 	const kind = "ConfigMap"
 
-	o, ok := obj.(*v1.ConfigMap)
+	o, ok := obj.(*metav1.PartialObjectMetadata)
 	if !ok {
 		log.Warnf("Got an unexpected, unsupported, object. Not an ConfigMap")
 		return
 	}
 
-	log.Infof("Checking %s for client creation '%s' from namespace '%s' ...", kind, o.Name, o.Namespace)
+	log.Debugf("Checking %s for clients '%s' from namespace '%s' ...", kind, o.Name, o.Namespace)
+
+	tdata := newTemplateData(kind, o, nil)
+	clients, err := extractClients(o.GetAnnotations(), tdata)
+	if err == nil {
+		var (
+			data  string
+			found bool
+		)
+		data, found, err = c.clientsData(o)
+		if found && err == nil {
+			var list []*staticClient
+			if list, err = parseStaticClients([]byte(data)); err != nil {
+				err = fmt.Errorf("invalid data key '%s': %s", configMapClientsKey, err)
+			} else {
+				err = expandClients(list, tdata)
+			}
+			clients = append(clients, list...)
+		}
+	}
+	reconcileObject(c.reconciler, newObjectRef(kind, v1.SchemeGroupVersion.WithResource("configmaps"), o), tdata, clients, err)
+}
 
-	static_client_id, static_client_name, static_client_redirect_uri, static_client_secret, err := extractAnnotations(o.GetAnnotations())
+// Return the clients key of a ConfigMap, and whether it has one. The ConfigMap
+// is only fetched when its resource version changed
+func (c *ConfigMapClient) clientsData(o *metav1.PartialObjectMetadata) (string, bool, error) {
+	key := o.Namespace + "/" + o.Name
+
+	c.mu.Lock()
+	cached, ok := c.data[key]
+	c.mu.Unlock()
+	if ok && cached.resourceVersion == o.ResourceVersion {
+		return cached.data, cached.found, nil
+	}
+
+	cm, err := c.client.CoreV1().ConfigMaps(o.Namespace).Get(context.TODO(), o.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		// Deleted since, the deletion event follows
+		return "", false, nil
+	}
 	if err != nil {
-		log.Infof("Ignoring %s '%s' from namespace '%s' - %s", kind, o.Name, o.Namespace, err)
-		return
+		return "", false, fmt.Errorf("failed to read ConfigMap: %s", err)
 	}
 
-	addDexStaticClient(c.dexClient, kind, o.Name, o.Namespace, static_client_id, static_client_name, static_client_redirect_uri, static_client_secret)
+	data, found := cm.Data[configMapClientsKey]
+	c.mu.Lock()
+	c.data[key] = configMapData{resourceVersion: cm.ResourceVersion, data: data, found: found}
+	c.mu.Unlock()
+	return data, found, nil
 }
 
 // Handle ConfigMap update event
 func (c *ConfigMapClient) OnUpdate(oldObj, newObj interface{}) {
-	c.OnDelete(oldObj)
 	c.OnAdd(newObj)
 }
 
@@ -308,47 +545,74 @@ func (c *ConfigMapClient) OnUpdate(oldObj, newObj interface{}) {
 func (c *ConfigMapClient) OnDelete(obj interface{}) {
 	const kind = "ConfigMap"
 
-	o, ok := obj.(*v1.ConfigMap)
+	o, ok := deletedObject(obj).(*metav1.PartialObjectMetadata)
 	if !ok {
 		return
 	}
 
 	log.Debugf("Checking %s for client deletion for '%s' from namespace '%s' ...", kind, o.Name, o.Namespace)
 
-	static_client_id, ok := o.GetAnnotations()[AnnotationDexStaticClientId]
-	if !ok {
-		log.Debugf("Ignoring %s '%s' from namespace '%s' - missing %s", kind, o.Name, o.Namespace, AnnotationDexStaticClientId)
-		return
-	}
+	c.mu.Lock()
+	delete(c.data, o.Namespace+"/"+o.Name)
+	c.mu.Unlock()
 
-	deleteDexStaticClient(c.dexClient, kind, o.Name, o.Namespace, static_client_id)
+	c.reconciler.remove(newObjectRef(kind, v1.SchemeGroupVersion.WithResource("configmaps"), o))
 }
 
-// Handle Client creation on Secret event
+// Handle Client creation on Secret event. Secrets are watched by metadata only,
+// the full Secret is only fetched when the secret-key annotation points at one
+// of its keys, and isn't kept
 func (c *SecretClient) OnAdd(obj interface{}) {
 
 	const kind = "Secret"
 
-	o, ok := obj.(*v1.Secret)
+	o, ok := obj.(*metav1.PartialObjectMetadata)
 	if !ok {
 		log.Warnf("Got an unexpected, unsupported, object. Not an Secret")
 		return
 	}
 
-	log.Infof("Checking %s for client creation '%s' from namespace '%s' ...", kind, o.Name, o.Namespace)
+	log.Debugf("Checking %s for clients '%s' from namespace '%s' ...", kind, o.Name, o.Namespace)
 
-	static_client_id, static_client_name, static_client_redirect_uri, static_client_secret, err := extractAnnotations(o.GetAnnotations())
-	if err != nil {
-		log.Infof("Ignoring %s '%s' from namespace '%s' - %s", kind, o.Name, o.Namespace, err)
-		return
+	ref := newObjectRef(kind, v1.SchemeGroupVersion.WithResource("secrets"), o)
+	tdata := newTemplateData(kind, o, nil)
+	ann := o.GetAnnotations()
+	if secretKey, ok := getAnnotation(ann, AnnotationDexStaticClientSecretKey); ok {
+		if _, ok := getAnnotation(ann, AnnotationDexStaticClientSecret); ok {
+			c.reconciler.reject(ref, fmt.Errorf("annotations '%s' and '%s' can't be used together",
+				annotationName(AnnotationDexStaticClientSecret), annotationName(AnnotationDexStaticClientSecretKey)))
+			return
+		}
+		secret, err := c.client.CoreV1().Secrets(o.Namespace).Get(context.TODO(), o.Name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			// Deleted since, the deletion event follows
+			return
+		}
+		if err != nil {
+			c.reconciler.reject(ref, fmt.Errorf("failed to read Secret: %s", err))
+			return
+		}
+		value, ok := secret.Data[secretKey]
+		if !ok {
+			c.reconciler.reject(ref, fmt.Errorf("invalid annotation '%s': no key '%s'", annotationName(AnnotationDexStaticClientSecretKey), secretKey))
+			return
+		}
+
+		// The secret is only added to a copy, which isn't kept
+		withSecret := make(map[string]string, len(ann)+1)
+		for k, v := range ann {
+			withSecret[k] = v
+		}
+		withSecret[annotationName(AnnotationDexStaticClientSecret)] = string(value)
+		ann = withSecret
 	}
 
-	addDexStaticClient(c.dexClient, kind, o.Name, o.Namespace, static_client_id, static_client_name, static_client_redirect_uri, static_client_secret)
+	clients, err := extractClients(ann, tdata)
+	reconcileObject(c.reconciler, ref, tdata, clients, err)
 }
 
 // Handle Secret update event
 func (c *SecretClient) OnUpdate(oldObj, newObj interface{}) {
-	c.OnDelete(oldObj)
 	c.OnAdd(newObj)
 }
 
@@ -356,24 +620,75 @@ func (c *SecretClient) OnUpdate(oldObj, newObj interface{}) {
 func (c *SecretClient) OnDelete(obj interface{}) {
 	const kind = "Secret"
 
-	o, ok := obj.(*v1.Secret)
+	o, ok := deletedObject(obj).(*metav1.PartialObjectMetadata)
 	if !ok {
 		return
 	}
 
 	log.Debugf("Checking %s for client deletion for '%s' from namespace '%s' ...", kind, o.Name, o.Namespace)
 
-	static_client_id, ok := o.GetAnnotations()[AnnotationDexStaticClientId]
+	c.reconciler.remove(newObjectRef(kind, v1.SchemeGroupVersion.WithResource("secrets"), o))
+}
+
+// Handle Client creation on Service event
+func (c *ServiceClient) OnAdd(obj interface{}) {
+
+	const kind = "Service"
+
+	o, ok := obj.(*v1.Service)
+	if !ok {
+		log.Warnf("Got an unexpected, unsupported, object. Not a Service")
+		return
+	}
+
+	log.Debugf("Checking %s for clients '%s' from namespace '%s' ...", kind, o.Name, o.Namespace)
+
+	tdata := newTemplateData(kind, o, serviceHosts(o))
+	clients, err := extractClients(o.GetAnnotations(), tdata)
+	reconcileObject(c.reconciler, newObjectRef(kind, v1.SchemeGroupVersion.WithResource("services"), o), tdata, clients, err)
+}
+
+// Return the hosts of a Service, from its load balancer status
+func serviceHosts(o *v1.Service) []string {
+	var hosts []string
+	for _, ingress := range o.Status.LoadBalancer.Ingress {
+		if ingress.Hostname != "" {
+			hosts = append(hosts, ingress.Hostname)
+		} else if ingress.IP != "" {
+			hosts = append(hosts, ingress.IP)
+		}
+	}
+	return hosts
+}
+
+// Handle Service update event
+func (c *ServiceClient) OnUpdate(oldObj, newObj interface{}) {
+	c.OnAdd(newObj)
+}
+
+// Handle Service deletion event
+func (c *ServiceClient) OnDelete(obj interface{}) {
+	const kind = "Service"
+
+	o, ok := deletedObject(obj).(*v1.Service)
 	if !ok {
-		log.Debugf("Ignoring %s '%s' from namespace '%s' - missing %s", kind, o.Name, o.Namespace, AnnotationDexStaticClientId)
 		return
 	}
 
-	deleteDexStaticClient(c.dexClient, kind, o.Name, o.Namespace, static_client_id)
+	log.Debugf("Checking %s for client deletion for '%s' from namespace '%s' ...", kind, o.Name, o.Namespace)
+
+	c.reconciler.remove(newObjectRef(kind, v1.SchemeGroupVersion.WithResource("services"), o))
+}
+
+// Return a new recorder to report problems as events on the watched objects
+func newEventRecorder(client *kubernetes.Clientset) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events(v1.NamespaceAll)})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "dex-k8s-ingress-watcher"})
 }
 
-// Return a new k8s client based on local or in-cluster configuration
-func newClient(kubeconfig string, inCluster bool) *kubernetes.Clientset {
+// Return a k8s client configuration based on local or in-cluster configuration
+func newConfig(kubeconfig string, inCluster bool) *rest.Config {
 	var err error
 	var config *rest.Config
 	if kubeconfig != "" && !inCluster {
@@ -383,15 +698,33 @@ func newClient(kubeconfig string, inCluster bool) *kubernetes.Clientset {
 		config, err = rest.InClusterConfig()
 		exitOnError(err)
 	}
+	return config
+}
 
+// Return a new k8s client
+func newClient(config *rest.Config) *kubernetes.Clientset {
 	client, err := kubernetes.NewForConfig(config)
 	exitOnError(err)
 	return client
 }
 
-// Watch all extensions/v1beta1 Ingresses in all namespaces and add event-handlers
-func watchExtensionsV1Beta1Ingress(client *kubernetes.Clientset, rs ...cache.ResourceEventHandler) cache.SharedInformer {
-	lw := cache.NewListWatchFromClient(client.ExtensionsV1beta1().RESTClient(), "ingresses", v1.NamespaceAll, fields.Everything())
+// Return a new k8s client reading only the metadata of objects
+func newMetadataClient(config *rest.Config) metadata.Interface {
+	client, err := metadata.NewForConfig(config)
+	exitOnError(err)
+	return client
+}
+
+// Return a new dynamic k8s client, to handle objects of any kind
+func newDynamicClient(config *rest.Config) dynamic.Interface {
+	client, err := dynamic.NewForConfig(config)
+	exitOnError(err)
+	return client
+}
+
+// Watch all extensions/v1beta1 Ingresses in a namespace, or all, and add event-handlers
+func watchExtensionsV1Beta1Ingress(client *kubernetes.Clientset, namespace string, rs ...cache.ResourceEventHandler) cache.SharedInformer {
+	lw := cache.NewListWatchFromClient(client.ExtensionsV1beta1().RESTClient(), "ingresses", namespace, fields.Everything())
 	sw := cache.NewSharedInformer(lw, new(extv1beta1.Ingress), SyncPeriodInMinutes*time.Minute)
 	for _, r := range rs {
 		sw.AddEventHandler(r)
@@ -399,9 +732,9 @@ func watchExtensionsV1Beta1Ingress(client *kubernetes.Clientset, rs ...cache.Res
 	return sw
 }
 
-// Watch all networking/v1beta1 Ingresses in all namespaces and add event-handlers
-func watchNetworkingV1Beta1Ingress(client *kubernetes.Clientset, rs ...cache.ResourceEventHandler) cache.SharedInformer {
-	lw := cache.NewListWatchFromClient(client.NetworkingV1beta1().RESTClient(), "ingresses", v1.NamespaceAll, fields.Everything())
+// Watch all networking/v1beta1 Ingresses in a namespace, or all, and add event-handlers
+func watchNetworkingV1Beta1Ingress(client *kubernetes.Clientset, namespace string, rs ...cache.ResourceEventHandler) cache.SharedInformer {
+	lw := cache.NewListWatchFromClient(client.NetworkingV1beta1().RESTClient(), "ingresses", namespace, fields.Everything())
 	sw := cache.NewSharedInformer(lw, new(netv1beta1.Ingress), SyncPeriodInMinutes*time.Minute)
 	for _, r := range rs {
 		sw.AddEventHandler(r)
@@ -409,9 +742,9 @@ func watchNetworkingV1Beta1Ingress(client *kubernetes.Clientset, rs ...cache.Res
 	return sw
 }
 
-// Watch all networking/v1 Ingresses in all namespaces and add event-handlers
-func watchNetworkingV1Ingress(client *kubernetes.Clientset, rs ...cache.ResourceEventHandler) cache.SharedInformer {
-	lw := cache.NewListWatchFromClient(client.NetworkingV1().RESTClient(), "ingresses", v1.NamespaceAll, fields.Everything())
+// Watch all networking/v1 Ingresses in a namespace, or all, and add event-handlers
+func watchNetworkingV1Ingress(client *kubernetes.Clientset, namespace string, rs ...cache.ResourceEventHandler) cache.SharedInformer {
+	lw := cache.NewListWatchFromClient(client.NetworkingV1().RESTClient(), "ingresses", namespace, fields.Everything())
 	sw := cache.NewSharedInformer(lw, new(netv1.Ingress), SyncPeriodInMinutes*time.Minute)
 	for _, r := range rs {
 		sw.AddEventHandler(r)
@@ -419,28 +752,107 @@ func watchNetworkingV1Ingress(client *kubernetes.Clientset, rs ...cache.Resource
 	return sw
 }
 
-// Watch all configmaps matching label selector in all namespaces and add event-handlers
-func watchConfigMaps(client *kubernetes.Clientset, rs ...cache.ResourceEventHandler) cache.SharedInformer {
+// Watch the metadata of all configmaps matching label selector in a namespace, or all, and add event-handlers
+func watchConfigMaps(client metadata.Interface, namespace string, rs ...cache.ResourceEventHandler) cache.SharedInformer {
+	return watchMetadata(client, v1.SchemeGroupVersion.WithResource("configmaps"), namespace, rs...)
+}
+
+// Watch the metadata of all secrets matching label selector in a namespace, or all, and add event-handlers
+func watchSecrets(client metadata.Interface, namespace string, rs ...cache.ResourceEventHandler) cache.SharedInformer {
+	return watchMetadata(client, v1.SchemeGroupVersion.WithResource("secrets"), namespace, rs...)
+}
+
+// Watch the metadata of all objects of a resource matching label selector in a
+// namespace, or all, and add event-handlers
+func watchMetadata(client metadata.Interface, resource schema.GroupVersionResource, namespace string, rs ...cache.ResourceEventHandler) cache.SharedInformer {
 	optionsModifier := func(options *metav1.ListOptions) {
 		options.LabelSelector = configMapSecretsSelectorLabels
 	}
 
-	lw := cache.NewFilteredListWatchFromClient(client.CoreV1().RESTClient(), "configmaps", v1.NamespaceAll, optionsModifier)
-	sw := cache.NewSharedInformer(lw, new(v1.ConfigMap), SyncPeriodInMinutes*time.Minute)
+	sw := metadatainformer.NewFilteredMetadataInformer(client, resource, namespace, SyncPeriodInMinutes*time.Minute, cache.Indexers{}, optionsModifier).Informer()
 	for _, r := range rs {
 		sw.AddEventHandler(r)
 	}
 	return sw
 }
 
-// Watch all secrets matching label selector in all namespaces and add event-handlers
-func watchSecrets(client *kubernetes.Clientset, rs ...cache.ResourceEventHandler) cache.SharedInformer {
+// Watch all objects of a resource in a namespace, or all, through the dynamic
+// client and add event-handlers
+func watchDynamic(client dynamic.Interface, resource schema.GroupVersionResource, namespace string, rs ...cache.ResourceEventHandler) cache.SharedInformer {
+	sw := dynamicinformer.NewFilteredDynamicInformer(client, resource, namespace, SyncPeriodInMinutes*time.Minute, cache.Indexers{}, nil).Informer()
+	for _, r := range rs {
+		sw.AddEventHandler(r)
+	}
+	return sw
+}
+
+// Return the preferred version serving a kind in an API group, out of the
+// given versions. Returns false if none serves it
+func servedResource(client *kubernetes.Clientset, group string, versions []string, kind string) (schema.GroupVersionResource, bool) {
+	for _, version := range versions {
+		gv := schema.GroupVersion{Group: group, Version: version}
+		resources, err := client.ServerResourcesForGroupVersion(gv.String())
+		if errors.IsNotFound(err) {
+			continue
+		}
+		exitOnError(err)
+		for _, resource := range resources.APIResources {
+			if resource.Kind == kind && !strings.Contains(resource.Name, "/") {
+				return gv.WithResource(resource.Name), true
+			}
+		}
+	}
+	return schema.GroupVersionResource{}, false
+}
+
+// Watch all networking/v1 IngressClasses and add event-handlers
+func watchNetworkingV1IngressClasses(client *kubernetes.Clientset, rs ...cache.ResourceEventHandler) cache.SharedInformer {
+	lw := cache.NewListWatchFromClient(client.NetworkingV1().RESTClient(), "ingressclasses", v1.NamespaceAll, fields.Everything())
+	sw := cache.NewSharedInformer(lw, new(netv1.IngressClass), SyncPeriodInMinutes*time.Minute)
+	for _, r := range rs {
+		sw.AddEventHandler(r)
+	}
+	return sw
+}
+
+// Watch all networking/v1beta1 IngressClasses and add event-handlers
+func watchNetworkingV1Beta1IngressClasses(client *kubernetes.Clientset, rs ...cache.ResourceEventHandler) cache.SharedInformer {
+	lw := cache.NewListWatchFromClient(client.NetworkingV1beta1().RESTClient(), "ingressclasses", v1.NamespaceAll, fields.Everything())
+	sw := cache.NewSharedInformer(lw, new(netv1beta1.IngressClass), SyncPeriodInMinutes*time.Minute)
+	for _, r := range rs {
+		sw.AddEventHandler(r)
+	}
+	return sw
+}
+
+// Watch all services matching label selector in a namespace, or all, and add event-handlers
+func watchServices(client *kubernetes.Clientset, namespace string, rs ...cache.ResourceEventHandler) cache.SharedInformer {
 	optionsModifier := func(options *metav1.ListOptions) {
 		options.LabelSelector = configMapSecretsSelectorLabels
 	}
 
-	lw := cache.NewFilteredListWatchFromClient(client.CoreV1().RESTClient(), "secrets", v1.NamespaceAll, optionsModifier)
-	sw := cache.NewSharedInformer(lw, new(v1.Secret), SyncPeriodInMinutes*time.Minute)
+	lw := cache.NewFilteredListWatchFromClient(client.CoreV1().RESTClient(), "services", namespace, optionsModifier)
+	sw := cache.NewSharedInformer(lw, new(v1.Service), SyncPeriodInMinutes*time.Minute)
+	for _, r := range rs {
+		sw.AddEventHandler(r)
+	}
+	return sw
+}
+
+// Watch all namespaces and add event-handlers
+func watchNamespaces(client *kubernetes.Clientset, rs ...cache.ResourceEventHandler) cache.SharedInformer {
+	lw := cache.NewListWatchFromClient(client.CoreV1().RESTClient(), "namespaces", v1.NamespaceAll, fields.Everything())
+	sw := cache.NewSharedInformer(lw, new(v1.Namespace), SyncPeriodInMinutes*time.Minute)
+	for _, r := range rs {
+		sw.AddEventHandler(r)
+	}
+	return sw
+}
+
+// Watch a single configmap and add event-handlers
+func watchConfigMap(client *kubernetes.Clientset, namespace string, name string, rs ...cache.ResourceEventHandler) cache.SharedInformer {
+	lw := cache.NewListWatchFromClient(client.CoreV1().RESTClient(), "configmaps", namespace, fields.OneTermEqualSelector("metadata.name", name))
+	sw := cache.NewSharedInformer(lw, new(v1.ConfigMap), SyncPeriodInMinutes*time.Minute)
 	for _, r := range rs {
 		sw.AddEventHandler(r)
 	}
@@ -457,10 +869,50 @@ func exitOnError(err error) {
 // CLI flags
 var CLI struct {
 	Serve struct {
-		InCluster      bool   `name:"incluster" help:"use in cluster configuration."`
-		KubeConfig     string `name:"kubeconfig" type:"path" default:"~/.kube/config" help:"path to kubeconfig (if not in running inside a cluster)"`
+		InCluster    bool   `name:"incluster" help:"use in cluster configuration."`
+		KubeConfig   string `name:"kubeconfig" type:"path" default:"~/.kube/config" help:"path to kubeconfig (if not in running inside a cluster)"`
+		Backend      string `name:"backend" enum:"dex,kubernetes,static-config,keycloak,hydra,memory" default:"dex" help:"where to register clients: dex through its grpc api, kubernetes to write the objects of dex's kubernetes storage, static-config to render them in dex's config, keycloak, hydra, or memory to only log them"`
+		DexNamespace string `name:"dex-namespace" help:"namespace of dex's kubernetes storage, for the kubernetes backend"`
+
+		StaticConfigTarget     string        `name:"static-config-target" placeholder:"KIND/NAMESPACE/NAME" help:"configmap or secret holding dex's config, for the static-config backend"`
+		StaticConfigKey        string        `name:"static-config-key" default:"config.yaml" help:"key of dex's config in the static config target"`
+		StaticConfigDeployment string        `name:"static-config-deployment" placeholder:"NAMESPACE/NAME" help:"dex deployment to roll out when the static config changes"`
+		StaticConfigDebounce   time.Duration `name:"static-config-debounce" default:"5s" help:"time to wait for more changes before writing the static config"`
+
+		KeycloakURL          string `name:"keycloak-url" help:"base url of keycloak, for the keycloak backend"`
+		KeycloakRealm        string `name:"keycloak-realm" help:"keycloak realm to register clients in"`
+		KeycloakClientID     string `name:"keycloak-client-id" help:"service-account client to authenticate to keycloak with"`
+		KeycloakClientSecret string `name:"keycloak-client-secret" env:"KEYCLOAK_CLIENT_SECRET" help:"secret of the service-account client"`
+
+		HydraAdminURL string `name:"hydra-admin-url" help:"url of hydra's admin api, for the hydra backend"`
+
 		DexGrpcService string `name:"dex-grpc-address" default:"127.0.0.1:5557" help:"dex grpc address"`
+		DexEndpoints   string `name:"dex-endpoints-file" type:"path" help:"path to a list of named dex endpoints to register clients with, instead of --dex-grpc-address"`
 		LogJson        bool   `name:"log-json" help:"set log formatter to json"`
+		DefaultLogoURL string `name:"default-logo-url" help:"logo url for clients without a logo-url annotation"`
+
+		AnnotationPrefixes    []string `name:"annotation-prefix" default:"mintel.com/dex-k8s-ingress-watcher" help:"prefix of the annotations to look for, may be given several times, earlier ones take precedence"`
+		LabelSelector         string   `name:"label-selector" default:"mintel.com/dex-k8s-ingress-watcher=enabled" help:"label selector for the configmaps, secrets and services to watch"`
+		InsecureRedirectHosts []string `name:"insecure-redirect-host" default:"localhost,127.0.0.1,::1" help:"host allowed in plain http redirect uris, may be given several times"`
+		ConfigMapClientsKey   string   `name:"configmap-clients-key" default:"clients.yaml" help:"configmap data key holding a list of clients, in the format of dex staticClients"`
+
+		ClusterDomain string   `name:"cluster-domain" help:"domain of the cluster, available to templates as .ClusterDomain"`
+		TemplateVars  []string `name:"template-var" placeholder:"KEY=VALUE" help:"variable available to templates as .Vars.KEY, may be given several times"`
+
+		NamespaceClientIDs bool   `name:"namespace-client-ids" help:"register client ids as <namespace>-<client-id>"`
+		ClientIDTemplate   string `name:"client-id-template" help:"go template for the client ids registered in dex, over .ClientID, .Namespace, .Name and .Kind"`
+		CollisionPolicy    string `name:"collision-policy" enum:"oldest-wins,reject,merge" default:"oldest-wins" help:"how to resolve several resources defining the same client id: oldest-wins, reject or merge"`
+
+		Namespaces        []string `name:"namespaces" help:"namespaces to watch, all if unset. Only needs Roles in those namespaces"`
+		ExcludeNamespaces []string `name:"exclude-namespaces" help:"namespaces to ignore"`
+		NamespaceSelector string   `name:"namespace-selector" help:"label selector for the namespaces to watch"`
+
+		IngressClasses []string `name:"ingress-class" help:"class of the ingresses to watch, all if unset, may be given several times. Ingresses without a class belong to the default IngressClass"`
+
+		PolicyFile      string `name:"policy-file" type:"path" help:"path to a policy restricting the clients of each namespace"`
+		PolicyConfigMap string `name:"policy-configmap" placeholder:"NAMESPACE/NAME" help:"configmap holding a policy restricting the clients of each namespace, under the policy.yaml key"`
+
+		ResourcesFile string `name:"resources-file" type:"path" help:"path to a list of other resources to watch, with JSONPath expressions for their client id, hosts and redirect uris"`
 
 		CACrtPath     string `name:"ca-crt" type:"path" help:"CA certificate path"`
 		ClientCrtPath string `name:"client-crt" type:"path" help:"client certificate path"`
@@ -469,6 +921,9 @@ var CLI struct {
 		EnableIngressController   bool `name:"ingress-controller" negatable:"" default:"true" help:"Enable the controller loop for ingresses"`
 		EnableConfigmapController bool `name:"configmap-controller" negatable:"" default:"false" help:"Enable the configmap controller loop"`
 		EnableSecretController    bool `name:"secret-controller" negatable:"" default:"false" help:"Enable the secret controller loop"`
+		EnableServiceController   bool `name:"service-controller" negatable:"" default:"false" help:"Enable the service controller loop"`
+		EnableHTTPRouteController bool `name:"httproute-controller" negatable:"" default:"true" help:"Enable the controller loop for gateway api httproutes, if served"`
+		EnableRouteController     bool `name:"route-controller" negatable:"" default:"true" help:"Enable the controller loop for openshift routes, if served"`
 	} `cmd:"serve" help:"Run it"`
 }
 
@@ -491,11 +946,77 @@ func main() {
 			log.SetFormatter(&log.JSONFormatter{})
 		}
 
-		client := newClient(CLI.Serve.KubeConfig, CLI.Serve.InCluster)
-		dexClient := newDexClient(CLI.Serve.DexGrpcService, CLI.Serve.CACrtPath, CLI.Serve.ClientCrtPath, CLI.Serve.ClientKeyPath)
+		defaultLogoURL = CLI.Serve.DefaultLogoURL
+		annotationPrefixes = CLI.Serve.AnnotationPrefixes
+		configMapClientsKey = CLI.Serve.ConfigMapClientsKey
+		insecureRedirectHosts = CLI.Serve.InsecureRedirectHosts
+		clusterDomain = CLI.Serve.ClusterDomain
+		for _, v := range CLI.Serve.TemplateVars {
+			parts := strings.SplitN(v, "=", 2)
+			if len(parts) != 2 {
+				exitOnError(fmt.Errorf("--template-var must be given as KEY=VALUE, got '%s'", v))
+			}
+			templateVars[parts[0]] = parts[1]
+		}
+
+		selector, err := labels.Parse(CLI.Serve.LabelSelector)
+		exitOnError(err)
+		configMapSecretsSelectorLabels = selector.String()
+
+		if CLI.Serve.NamespaceClientIDs && CLI.Serve.ClientIDTemplate == "" {
+			CLI.Serve.ClientIDTemplate = NamespaceClientIDTemplate
+		}
+		if CLI.Serve.ClientIDTemplate != "" {
+			clientIDTemplate, err = parseClientIDTemplate(CLI.Serve.ClientIDTemplate)
+			exitOnError(err)
+		}
+
+		filter, err := newNamespaceFilter(CLI.Serve.Namespaces, CLI.Serve.ExcludeNamespaces, CLI.Serve.NamespaceSelector)
+		exitOnError(err)
+
+		config := newConfig(CLI.Serve.KubeConfig, CLI.Serve.InCluster)
+		client := newClient(config)
+		dynamicClient := newDynamicClient(config)
+		metadataClient := newMetadataClient(config)
 
-		r := http.NewServeMux()
-		r.Handle("/healthz", healthcheck.Handler(
+		var backend Backend
+		switch CLI.Serve.Backend {
+		case BackendKubernetes:
+			if CLI.Serve.DexNamespace == "" {
+				exitOnError(fmt.Errorf("--dex-namespace is needed by the kubernetes backend"))
+			}
+			backend = newKubernetesBackend(dynamicClient, CLI.Serve.DexNamespace)
+		case BackendStaticConfig:
+			backend, err = newStaticConfigBackend(client, CLI.Serve.StaticConfigTarget, CLI.Serve.StaticConfigKey, CLI.Serve.StaticConfigDeployment, CLI.Serve.StaticConfigDebounce)
+			exitOnError(err)
+			if strings.HasPrefix(CLI.Serve.StaticConfigTarget, "configmap/") {
+				log.Warnf("Static config: client secrets are written to ConfigMap '%s', readable by anyone allowed to read ConfigMaps in its namespace. Use a Secret instead",
+					strings.TrimPrefix(CLI.Serve.StaticConfigTarget, "configmap/"))
+			}
+		case BackendKeycloak:
+			backend, err = newKeycloakBackend(CLI.Serve.KeycloakURL, CLI.Serve.KeycloakRealm, CLI.Serve.KeycloakClientID, CLI.Serve.KeycloakClientSecret)
+			exitOnError(err)
+		case BackendHydra:
+			backend, err = newHydraBackend(CLI.Serve.HydraAdminURL)
+			exitOnError(err)
+		case BackendMemory:
+			log.Warnf("Using the memory backend, clients are not registered anywhere")
+			backend = newMemoryBackend()
+		default:
+			if CLI.Serve.DexEndpoints != "" {
+				dexEndpoints, err = loadDexEndpointsFile(CLI.Serve.DexEndpoints)
+				exitOnError(err)
+				log.Infof("Loaded %d dex endpoints from '%s'", len(dexEndpoints.Endpoints), CLI.Serve.DexEndpoints)
+				backend = newMultiDexBackend(dexEndpoints)
+				break
+			}
+			backend = newDexBackend(newDexClient(CLI.Serve.DexGrpcService, CLI.Serve.CACrtPath, CLI.Serve.ClientCrtPath, CLI.Serve.ClientKeyPath))
+		}
+		r := newReconciler(backend, newEventRecorder(client), dynamicClient, CLI.Serve.CollisionPolicy)
+		go r.runRetries(nil)
+
+		mux := http.NewServeMux()
+		mux.Handle("/healthz", healthcheck.Handler(
 			healthcheck.WithChecker(
 				"local", healthcheck.CheckerFunc(
 					func(ctx context.Context) error {
@@ -505,78 +1026,188 @@ func main() {
 				),
 			),
 		))
-		r.Handle("/readiness", healthcheck.Handler(
-			healthcheck.WithChecker(
-				"dex-grpc", healthcheck.CheckerFunc(
-					func(ctx context.Context) error {
-						// ping dex
-						req := &api.VersionReq{}
-						_, err := dexClient.GetVersion(context.TODO(), req)
-						return err
-					},
+		if multi, ok := backend.(*multiDexBackend); ok {
+			// Reported for each endpoint
+			mux.Handle("/readiness", healthcheck.Handler(multi.checkers()...))
+			mux.Handle("/metrics", multi)
+		} else {
+			mux.Handle("/readiness", healthcheck.Handler(
+				healthcheck.WithChecker(
+					"backend", healthcheck.CheckerFunc(
+						func(ctx context.Context) error {
+							// ping the backend
+							return backend.Health(ctx)
+						},
+					),
 				),
-			),
-		))
+			))
+		}
 
 		go func() {
-			exitOnError(http.ListenAndServe(":8080", r))
+			exitOnError(http.ListenAndServe(":8080", mux))
 		}()
 
-		if CLI.Serve.EnableIngressController {
-			c_ing := NewIngressClient(dexClient)
+		if CLI.Serve.PolicyFile != "" && CLI.Serve.PolicyConfigMap != "" {
+			exitOnError(fmt.Errorf("--policy-file and --policy-configmap can't be used together"))
+		}
 
-			group, err := client.ServerResourcesForGroupVersion("networking.k8s.io/v1")
-			if !errors.IsNotFound(err) {
-				exitOnError(err)
-				for _, resource := range group.APIResources {
-					if resource.Kind == "Ingress" {
-						log.Infof("Starting controller loop for networking/v1 Ingress")
-						wi := watchNetworkingV1Ingress(client, c_ing)
-						go wi.Run(nil)
-						break
-					}
-				}
+		if CLI.Serve.PolicyFile != "" {
+			p, err := loadPolicyFile(CLI.Serve.PolicyFile)
+			exitOnError(err)
+			log.Infof("Loaded policy from '%s'", CLI.Serve.PolicyFile)
+			r.setPolicy(p)
+		}
+
+		if CLI.Serve.PolicyConfigMap != "" {
+			parts := strings.SplitN(CLI.Serve.PolicyConfigMap, "/", 2)
+			if len(parts) != 2 {
+				exitOnError(fmt.Errorf("--policy-configmap must be given as NAMESPACE/NAME"))
 			}
+			log.Infof("Starting controller loop for policy ConfigMap")
+			wp := watchConfigMap(client, parts[0], parts[1], NewPolicyClient(r))
+			go wp.Run(nil)
+			cache.WaitForCacheSync(nil, wp.HasSynced)
+			if !r.hasPolicy() {
+				exitOnError(fmt.Errorf("no valid policy found in ConfigMap '%s'", CLI.Serve.PolicyConfigMap))
+			}
+		}
 
-			group, err = client.ServerResourcesForGroupVersion("networking.k8s.io/v1beta")
-			if !errors.IsNotFound(err) {
-				exitOnError(err)
-				for _, resource := range group.APIResources {
-					if resource.Kind == "Ingress" {
-						log.Infof("Starting controller loop for networking/v1beta1 Ingress")
-						wi := watchNetworkingV1Beta1Ingress(client, c_ing)
-						go wi.Run(nil)
-						break
-					}
-				}
+		sources := &namespaceSources{filter: filter}
+		if len(CLI.Serve.Namespaces) == 0 || filter.needsNamespaces() || r.hasPolicy() {
+			// Needed for the namespace defaults, and to match the namespace
+			// selectors. Left out with a list of namespaces, which can then be
+			// watched with Roles only
+			log.Infof("Starting controller loop for Namespace")
+			wn := watchNamespaces(client, NewNamespaceClient(r, sources))
+			r.namespaces = wn.GetStore()
+			filter.namespaces = wn.GetStore()
+			go wn.Run(nil)
+			cache.WaitForCacheSync(nil, wn.HasSynced)
+		} else {
+			log.Infof("Not watching Namespaces, their default annotations are ignored")
+		}
+
+		// Start informers for the objects handled by a handler, in each watched namespace
+		run := func(handler cache.ResourceEventHandler, watch func(*kubernetes.Clientset, string, ...cache.ResourceEventHandler) cache.SharedInformer) {
+			for _, namespace := range filter.watched() {
+				w := watch(client, namespace, filter.handler(handler))
+				sources.add(w, handler)
+				go w.Run(nil)
 			}
+		}
 
-			group, err = client.ServerResourcesForGroupVersion("extensions/v1beta1")
-			if !errors.IsNotFound(err) {
-				exitOnError(err)
-				for _, resource := range group.APIResources {
-					if resource.Kind == "Ingress" {
-						log.Infof("Starting controller loop for  Ingress")
-						wi := watchExtensionsV1Beta1Ingress(client, c_ing)
-						go wi.Run(nil)
-						break
+		if CLI.Serve.EnableIngressController {
+			classes := newIngressClassFilter(CLI.Serve.IngressClasses)
+			c_ing := NewIngressClient(r, classes)
+
+			if classes.enabled() {
+				// Needed to find the default IngressClass
+				var wic cache.SharedInformer
+				if resource, ok := servedResource(client, netv1.GroupName, []string{"v1", "v1beta1"}, "IngressClass"); ok {
+					log.Infof("Starting controller loop for %s IngressClass", resource.GroupVersion())
+					if resource.Version == "v1" {
+						wic = watchNetworkingV1IngressClasses(client, NewIngressClassClient(sources))
+					} else {
+						wic = watchNetworkingV1Beta1IngressClasses(client, NewIngressClassClient(sources))
 					}
 				}
+				if wic != nil {
+					classes.store = wic.GetStore()
+					go wic.Run(nil)
+					cache.WaitForCacheSync(nil, wic.HasSynced)
+				} else {
+					log.Warnf("IngressClasses not served, only Ingresses with an explicit class are watched")
+				}
+			}
+
+			// Every served version returns the same Ingresses, only the preferred
+			// one is watched so that each is handled once
+			if _, ok := servedResource(client, netv1.GroupName, []string{"v1"}, "Ingress"); ok {
+				log.Infof("Starting controller loop for networking/v1 Ingress")
+				run(c_ing, watchNetworkingV1Ingress)
+			} else if _, ok := servedResource(client, netv1beta1.GroupName, []string{"v1beta1"}, "Ingress"); ok {
+				log.Infof("Starting controller loop for networking/v1beta1 Ingress")
+				run(c_ing, watchNetworkingV1Beta1Ingress)
+			} else if _, ok := servedResource(client, extv1beta1.GroupName, []string{"v1beta1"}, "Ingress"); ok {
+				log.Infof("Starting controller loop for extensions/v1beta1 Ingress")
+				run(c_ing, watchExtensionsV1Beta1Ingress)
+			} else {
+				log.Warnf("Ingresses not served, not starting their controller loop")
 			}
 		}
 
 		if CLI.Serve.EnableConfigmapController {
-			c_cm := NewConfigMapClient(dexClient)
+			c_cm := NewConfigMapClient(r, client)
 			log.Infof("Starting controller loop for ConfigMap")
-			wc := watchConfigMaps(client, c_cm)
-			go wc.Run(nil)
+			run(c_cm, func(_ *kubernetes.Clientset, namespace string, rs ...cache.ResourceEventHandler) cache.SharedInformer {
+				return watchConfigMaps(metadataClient, namespace, rs...)
+			})
 		}
 
 		if CLI.Serve.EnableSecretController {
-			c_sec := NewSecretClient(dexClient)
+			c_sec := NewSecretClient(r, client)
 			log.Infof("Starting controller loop for Secret")
-			sc := watchSecrets(client, c_sec)
-			go sc.Run(nil)
+			run(c_sec, func(_ *kubernetes.Clientset, namespace string, rs ...cache.ResourceEventHandler) cache.SharedInformer {
+				return watchSecrets(metadataClient, namespace, rs...)
+			})
+		}
+
+		if CLI.Serve.EnableServiceController {
+			c_svc := NewServiceClient(r)
+			log.Infof("Starting controller loop for Service")
+			run(c_svc, watchServices)
+		}
+
+		if CLI.Serve.EnableHTTPRouteController {
+			if resource, ok := servedResource(client, GatewayAPIGroup, httpRouteVersions, "HTTPRoute"); !ok {
+				log.Infof("Gateway API HTTPRoutes not served, not starting their controller loop")
+			} else if err := watchAllowed(client, resource, filter.watched()); err != nil {
+				log.Warnf("Not starting the controller loop for HTTPRoutes - %s", err)
+			} else {
+				c_route := NewHTTPRouteClient(r, resource)
+				log.Infof("Starting controller loop for %s HTTPRoute", resource.GroupVersion())
+				run(c_route, func(_ *kubernetes.Clientset, namespace string, rs ...cache.ResourceEventHandler) cache.SharedInformer {
+					return watchDynamic(dynamicClient, resource, namespace, rs...)
+				})
+			}
+		}
+
+		if CLI.Serve.EnableRouteController {
+			if _, ok := servedResource(client, RouteResource.Group, []string{RouteResource.Version}, "Route"); !ok {
+				log.Infof("OpenShift Routes not served, not starting their controller loop")
+			} else if err := watchAllowed(client, RouteResource, filter.watched()); err != nil {
+				log.Warnf("Not starting the controller loop for OpenShift Routes - %s", err)
+			} else {
+				c_route := NewRouteClient(r)
+				log.Infof("Starting controller loop for OpenShift Route")
+				run(c_route, func(_ *kubernetes.Clientset, namespace string, rs ...cache.ResourceEventHandler) cache.SharedInformer {
+					return watchDynamic(dynamicClient, RouteResource, namespace, rs...)
+				})
+			}
+		}
+
+		if CLI.Serve.ResourcesFile != "" {
+			resources, err := loadResourcesFile(CLI.Serve.ResourcesFile)
+			exitOnError(err)
+			for _, mapping := range resources.Resources {
+				resource := mapping.resource()
+				if _, ok := servedResource(client, resource.Group, []string{resource.Version}, mapping.Kind); !ok {
+					log.Warnf("%s %s not served, not starting its controller loop", resource.GroupVersion(), mapping.Kind)
+					continue
+				}
+				log.Infof("Starting controller loop for %s %s", resource.GroupVersion(), mapping.Kind)
+				run(NewDynamicResourceClient(r, mapping), func(_ *kubernetes.Clientset, namespace string, rs ...cache.ResourceEventHandler) cache.SharedInformer {
+					return watchDynamic(dynamicClient, resource, namespace, rs...)
+				})
+			}
+		}
+
+		cache.WaitForCacheSync(nil, sources.hasSynced)
+		r.setListed()
+		if static, ok := backend.(*staticConfigBackend); ok {
+			// Only rendered once every watched object is known
+			log.Infof("Static config: watched objects listed, writing clients")
+			static.start()
 		}
 
 		// Wait forever
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestExtractClients(t *testing.T) {
+	const p = DefaultAnnotationPrefix
+	o := &metav1.ObjectMeta{Namespace: "team-a", Name: "app"}
+
+	tests := []struct {
+		name string
+		ann  map[string]string
+		want []*staticClient
+		err  string
+	}{
+		{
+			name: "no client",
+			ann:  map[string]string{"other": "value"},
+		},
+		{
+			name: "single client",
+			ann: map[string]string{
+				p + "-client-id":     "app",
+				p + "-client-name":   "{{.Namespace}} app",
+				p + "-redirect-uri":  "https://a.example.com/callback, https://b.example.com/callback",
+				p + "-secret":        "secret",
+				p + "-logo-url":      "https://example.com/logo.png",
+				p + "-shared-client": "true",
+			},
+			want: []*staticClient{{
+				Id:           "app",
+				Name:         "team-a app",
+				Secret:       "secret",
+				RedirectURIs: []string{"https://a.example.com/callback", "https://b.example.com/callback"},
+				LogoURL:      "https://example.com/logo.png",
+				Shared:       true,
+			}},
+		},
+		{
+			name: "single client without secret",
+			ann:  map[string]string{p + "-client-id": "app"},
+			err:  "missing annotation '" + p + "-secret'",
+		},
+		{
+			name: "invalid shared-client",
+			ann: map[string]string{
+				p + "-client-id":     "app",
+				p + "-secret":        "secret",
+				p + "-shared-client": "sometimes",
+			},
+			err: "invalid annotation '" + p + "-shared-client'",
+		},
+		{
+			name: "list of clients",
+			ann: map[string]string{
+				p + "-clients": `[
+					{"id": "grafana", "secret": "a", "redirectURIs": ["https://{{.Host}}/grafana/callback"]},
+					{"id": "cli", "public": true, "redirectURIs": ["http://localhost:8000"], "trustedPeers": ["grafana"]}
+				]`,
+			},
+			want: []*staticClient{
+				{Id: "grafana", Secret: "a", RedirectURIs: []string{"https://app.example.com/grafana/callback"}},
+				{Id: "cli", Public: true, RedirectURIs: []string{"http://localhost:8000"}, TrustedPeers: []string{"grafana"}},
+			},
+		},
+		{
+			name: "single client and list",
+			ann: map[string]string{
+				p + "-client-id":    "app",
+				p + "-redirect-uri": "https://app.example.com/callback",
+				p + "-secret":       "secret",
+				p + "-clients":      `[{"id": "prometheus", "secret": "b", "redirectURIs": ["https://app.example.com/prometheus/callback"]}]`,
+			},
+			want: []*staticClient{
+				{Id: "app", Secret: "secret", RedirectURIs: []string{"https://app.example.com/callback"}},
+				{Id: "prometheus", Secret: "b", RedirectURIs: []string{"https://app.example.com/prometheus/callback"}},
+			},
+		},
+		{
+			name: "invalid list",
+			ann:  map[string]string{p + "-clients": `{"id": "app"}`},
+			err:  "invalid annotation '" + p + "-clients'",
+		},
+		{
+			name: "invalid template in list",
+			ann:  map[string]string{p + "-clients": `[{"id": "app", "name": "{{.Missing}}"}]`},
+			err:  "client 'app': invalid name template",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clients, err := extractClients(tt.ann, newTemplateData("Ingress", o, []string{"app.example.com"}))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(clients, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, clients)
+			}
+		})
+	}
+}
+
+func TestSecretClientSecretKey(t *testing.T) {
+	const p = DefaultAnnotationPrefix
+	client := fake.NewSimpleClientset(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "app"},
+		Data:       map[string][]byte{"client-secret": []byte("from-secret")},
+	})
+
+	tests := []struct {
+		name string
+		// Secret the annotations are on
+		secret string
+		ann    map[string]string
+		// Secret of the registered client, none if empty
+		want string
+		// Event recorded, none if empty
+		event string
+	}{
+		{
+			name:   "secret from key",
+			secret: "app",
+			ann:    map[string]string{p + "-secret-key": "client-secret"},
+			want:   "from-secret",
+		},
+		{
+			name:   "secret and secret-key",
+			secret: "app",
+			ann:    map[string]string{p + "-secret-key": "client-secret", p + "-secret": "inline"},
+			event:  "annotations '" + p + "-secret' and '" + p + "-secret-key' can't be used together",
+		},
+		{
+			name:   "missing key",
+			secret: "app",
+			ann:    map[string]string{p + "-secret-key": "other"},
+			event:  "invalid annotation '" + p + "-secret-key': no key 'other'",
+		},
+		{
+			name:   "deleted secret",
+			secret: "gone",
+			ann:    map[string]string{p + "-secret-key": "client-secret"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, backend, recorder := newTestReconciler(CollisionOldestWins)
+			c := NewSecretClient(r, client)
+
+			ann := map[string]string{
+				p + "-client-id":    "app",
+				p + "-redirect-uri": "https://app.example.com/callback",
+			}
+			for k, v := range tt.ann {
+				ann[k] = v
+			}
+			c.OnAdd(&metav1.PartialObjectMetadata{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: tt.secret, UID: "uid", Annotations: ann},
+			})
+
+			clients := backendClients(t, backend)
+			switch {
+			case tt.want == "" && len(clients) != 0:
+				t.Errorf("expected no clients, got %v", clients)
+			case tt.want != "" && (clients["app"] == nil || clients["app"].Secret != tt.want):
+				t.Errorf("expected client app with secret %q, got %v", tt.want, clients)
+			}
+
+			events := recordedEvents(recorder)
+			switch {
+			case tt.event == "" && len(events) != 0:
+				t.Errorf("expected no events, got %v", events)
+			case tt.event != "" && (len(events) != 1 || !strings.Contains(events[0], tt.event)):
+				t.Errorf("expected an event containing %q, got %v", tt.event, events)
+			}
+		})
+	}
+}
+
+func TestParseStaticClients(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []*staticClient
+		err  string
+	}{
+		{
+			name: "yaml list",
+			data: `
+- id: app
+  name: App
+  secret: secret
+  redirectURIs:
+  - https://app.example.com/callback
+  trustedPeers: [cli]
+- id: cli
+  public: true
+  redirectURIs: [http://localhost:8000]
+`,
+			want: []*staticClient{
+				{Id: "app", Name: "App", Secret: "secret", RedirectURIs: []string{"https://app.example.com/callback"}, TrustedPeers: []string{"cli"}},
+				{Id: "cli", Public: true, RedirectURIs: []string{"http://localhost:8000"}},
+			},
+		},
+		{
+			name: "json list",
+			data: `[{"id": "app", "secret": "secret", "redirectURIs": ["https://app.example.com/callback"], "endpoints": ["eu"]}]`,
+			want: []*staticClient{
+				{Id: "app", Secret: "secret", RedirectURIs: []string{"https://app.example.com/callback"}, Endpoints: []string{"eu"}},
+			},
+		},
+		{
+			name: "staticClients key",
+			data: `
+staticClients:
+- id: app
+  secret: secret
+  redirectURIs: [https://app.example.com/callback]
+`,
+			want: []*staticClient{
+				{Id: "app", Secret: "secret", RedirectURIs: []string{"https://app.example.com/callback"}},
+			},
+		},
+		{
+			name: "object without staticClients",
+			data: `clients: []`,
+			err:  "expected a list of clients or a staticClients key",
+		},
+		{
+			name: "dex only field",
+			data: `[{"id": "app", "secretEnv": "APP_SECRET"}]`,
+			err:  `unknown field "secretEnv"`,
+		},
+		{
+			name: "invalid yaml",
+			data: "- id: [app",
+			err:  "yaml",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clients, err := parseStaticClients([]byte(tt.data))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(clients, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, clients)
+			}
+		})
+	}
+}
+
+func TestConfigMapClientData(t *testing.T) {
+	const p = DefaultAnnotationPrefix
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "clients", ResourceVersion: "1"},
+		Data: map[string]string{
+			DefaultConfigMapClientsKey: `
+- id: grafana
+  secret: a
+  redirectURIs: ["https://{{.Namespace}}.example.com/grafana/callback"]
+- id: prometheus
+  secret: b
+  redirectURIs: ["https://{{.Namespace}}.example.com/prometheus/callback"]
+`,
+		},
+	}
+
+	tests := []struct {
+		name string
+		// Data of the ConfigMap, the one above if nil
+		data map[string]string
+		ann  map[string]string
+		// Registered client ids
+		want []string
+		// Event recorded, none if empty
+		event string
+	}{
+		{
+			name: "clients key",
+			want: []string{"grafana", "prometheus"},
+		},
+		{
+			name: "clients key and annotations",
+			ann: map[string]string{
+				p + "-client-id":    "app",
+				p + "-redirect-uri": "https://team-a.example.com/callback",
+				p + "-secret":       "secret",
+			},
+			want: []string{"app", "grafana", "prometheus"},
+		},
+		{
+			name: "no clients key",
+			data: map[string]string{"other": "value"},
+		},
+		{
+			name:  "invalid clients key",
+			data:  map[string]string{DefaultConfigMapClientsKey: "- idEnv: APP_ID"},
+			event: "invalid data key '" + DefaultConfigMapClientsKey + "'",
+		},
+		{
+			name: "same id in annotations and data",
+			ann: map[string]string{
+				p + "-client-id":    "grafana",
+				p + "-redirect-uri": "https://team-a.example.com/callback",
+				p + "-secret":       "secret",
+			},
+			event: "client 'grafana': defined more than once",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := cm.DeepCopy()
+			if tt.data != nil {
+				obj.Data = tt.data
+			}
+			r, backend, recorder := newTestReconciler(CollisionOldestWins)
+			c := NewConfigMapClient(r, fake.NewSimpleClientset(obj))
+
+			c.OnAdd(&metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "team-a", Name: "clients", UID: "uid", ResourceVersion: "1", Annotations: tt.ann,
+			}})
+
+			var ids []string
+			for id, client := range backendClients(t, backend) {
+				if id == "grafana" && !reflect.DeepEqual(client.RedirectURIs, []string{"https://team-a.example.com/grafana/callback"}) {
+					t.Errorf("expected expanded redirect uris, got %v", client.RedirectURIs)
+				}
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("expected clients %v, got %v", tt.want, ids)
+			}
+
+			events := recordedEvents(recorder)
+			switch {
+			case tt.event == "" && len(events) != 0:
+				t.Errorf("expected no events, got %v", events)
+			case tt.event != "" && (len(events) != 1 || !strings.Contains(events[0], tt.event)):
+				t.Errorf("expected an event containing %q, got %v", tt.event, events)
+			}
+		})
+	}
+}
+
+func TestConfigMapClientCache(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "clients", ResourceVersion: "1"},
+		Data:       map[string]string{DefaultConfigMapClientsKey: "[]"},
+	})
+	r, _, _ := newTestReconciler(CollisionOldestWins)
+	c := NewConfigMapClient(r, client)
+
+	gets := func() int {
+		n := 0
+		for _, action := range client.Actions() {
+			if action.GetVerb() == "get" {
+				n++
+			}
+		}
+		return n
+	}
+
+	// The ConfigMap is only read again once its resource version changes
+	for i, version := range []string{"1", "1", "2"} {
+		c.OnAdd(&metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "team-a", Name: "clients", UID: "uid", ResourceVersion: version,
+		}})
+		want := []int{1, 1, 2}[i]
+		if n := gets(); n != want {
+			t.Errorf("event %d: expected %d reads, got %d", i, want, n)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Annotations of Namespaces setting defaults for the clients of their objects.
+// The callback-path, logo-url, trusted-peers, enabled and endpoints ones can be overridden
+// by annotations of the objects
+const (
+	// Path of the redirect URI built for each host of objects without redirect URIs
+	AnnotationDexCallbackPath = "-callback-path"
+	// Comma separated trusted peers of clients without any
+	AnnotationDexTrustedPeers = "-trusted-peers"
+	// Whether clients of the namespace are registered at all
+	AnnotationDexEnabled = "-enabled"
+	// Comma separated glob patterns of the allowed redirect URI hosts
+	AnnotationDexAllowedHosts = "-allowed-hosts"
+	// Prefix added to the client ids of the namespace
+	AnnotationDexClientIDPrefix = "-client-id-prefix"
+)
+
+// Namespace annotations whose change requires syncing the namespace objects
+var namespaceDefaultAnnotations = []string{
+	AnnotationDexCallbackPath,
+	AnnotationDexStaticClientLogoURL,
+	AnnotationDexTrustedPeers,
+	AnnotationDexEnabled,
+	AnnotationDexAllowedHosts,
+	AnnotationDexClientIDPrefix,
+	AnnotationDexEndpoints,
+}
+
+// Defaults applying to the clients of an object, from the annotations of its
+// namespace and the object itself
+type namespaceDefaults struct {
+	CallbackPath   string
+	LogoURL        string
+	TrustedPeers   []string
+	Enabled        bool
+	AllowedHosts   []string
+	ClientIDPrefix string
+	Endpoints      []string
+}
+
+// Read the defaults for an object from the annotations of its namespace and
+// its own. Object annotations win, except for the allowed hosts and client id
+// prefix, which are up to the namespace
+func newNamespaceDefaults(nsAnn map[string]string, ann map[string]string) (*namespaceDefaults, error) {
+	lookup := func(key string) (string, bool, string) {
+		if value, ok := getAnnotation(ann, key); ok {
+			return value, true, "annotation"
+		}
+		value, ok := getAnnotation(nsAnn, key)
+		return value, ok, "namespace annotation"
+	}
+
+	d := &namespaceDefaults{Enabled: true}
+	d.CallbackPath, _, _ = lookup(AnnotationDexCallbackPath)
+	d.LogoURL, _, _ = lookup(AnnotationDexStaticClientLogoURL)
+	if value, ok, _ := lookup(AnnotationDexTrustedPeers); ok {
+		d.TrustedPeers = splitList(value)
+	}
+	if value, ok, source := lookup(AnnotationDexEnabled); ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s '%s': %s", source, annotationName(AnnotationDexEnabled), err)
+		}
+		d.Enabled = enabled
+	}
+	if value, ok, _ := lookup(AnnotationDexEndpoints); ok {
+		d.Endpoints = splitList(value)
+	}
+
+	if value, ok := getAnnotation(nsAnn, AnnotationDexAllowedHosts); ok {
+		d.AllowedHosts = splitList(value)
+	}
+	d.ClientIDPrefix, _ = getAnnotation(nsAnn, AnnotationDexClientIDPrefix)
+	return d, nil
+}
+
+// Split a comma separated list, dropping empty values
+func splitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// Apply the defaults to the clients of an object serving the given hosts with
+// the given scheme
+func (d *namespaceDefaults) apply(clients []*staticClient, scheme string, hosts []string) error {
+	for _, client := range clients {
+		if client == nil {
+			continue
+		}
+		if len(client.RedirectURIs) == 0 && d.CallbackPath != "" {
+			client.RedirectURIs = callbackURIs(scheme, hosts, d.CallbackPath)
+		}
+		if client.LogoURL == "" {
+			client.LogoURL = d.LogoURL
+		}
+		if len(client.TrustedPeers) == 0 {
+			client.TrustedPeers = d.TrustedPeers
+		}
+		if len(client.Endpoints) == 0 {
+			client.Endpoints = d.Endpoints
+		}
+
+		if len(d.AllowedHosts) > 0 {
+			for _, uri := range client.RedirectURIs {
+				u, err := url.Parse(uri)
+				if err != nil {
+					// Reported by the redirect URI validation
+					continue
+				}
+				if !matchAny(d.AllowedHosts, u.Hostname()) {
+					return fmt.Errorf("client '%s': redirect host '%s' is not allowed in the namespace", client.Id, u.Hostname())
+				}
+			}
+		}
+		if client.Id != "" && d.ClientIDPrefix != "" {
+			client.Id = d.ClientIDPrefix + client.Id
+			var peers []string
+			for _, peer := range client.TrustedPeers {
+				peers = append(peers, d.ClientIDPrefix+peer)
+			}
+			client.TrustedPeers = peers
+		}
+	}
+	return nil
+}
+
+// Return the redirect URIs for a callback path on each host. Wildcard hosts
+// are skipped, Dex matches redirect URIs verbatim
+func callbackURIs(scheme string, hosts []string, path string) []string {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	var uris []string
+	for _, host := range hosts {
+		if strings.Contains(host, "*") {
+			continue
+		}
+		uris = append(uris, scheme+"://"+host+path)
+	}
+	return uris
+}
+
+// Return the annotations of a namespace, if known
+func (r *reconciler) namespaceAnnotations(name string) map[string]string {
+	if r.namespaces == nil {
+		return nil
+	}
+	obj, exists, err := r.namespaces.GetByKey(name)
+	if err != nil || !exists {
+		return nil
+	}
+	if namespace, ok := obj.(*v1.Namespace); ok {
+		return namespace.Annotations
+	}
+	return nil
+}
+
+// Return whether the default annotations differ between two versions of a namespace
+func namespaceDefaultsChanged(old, new *v1.Namespace) bool {
+	for _, key := range namespaceDefaultAnnotations {
+		oldValue, oldOk := getAnnotation(old.Annotations, key)
+		newValue, newOk := getAnnotation(new.Annotations, key)
+		if oldOk != newOk || oldValue != newValue {
+			return true
+		}
+	}
+	return false
+}
+
+// An informer and the handler of its objects, to hand them again the objects
+// of a namespace whose defaults changed
+type namespaceSource struct {
+	informer cache.SharedInformer
+	handler  cache.ResourceEventHandler
+}
+
+// Sources of the objects defining clients
+type namespaceSources struct {
+	// Namespaces whose objects define clients
+	filter *namespaceFilter
+
+	mu      sync.Mutex
+	sources []namespaceSource
+}
+
+// Add a source of objects
+func (s *namespaceSources) add(informer cache.SharedInformer, handler cache.ResourceEventHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sources = append(s.sources, namespaceSource{informer: informer, handler: handler})
+}
+
+// Return whether every source listed its objects
+func (s *namespaceSources) hasSynced() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, source := range s.sources {
+		if !source.informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// Hand the objects of a namespace to their handlers again, or as deleted if
+// the namespace is no longer allowed by the filter
+func (s *namespaceSources) resync(namespace string) {
+	s.resyncMatching(func(o metav1.Object) bool {
+		return o.GetNamespace() == namespace
+	})
+	log.Debugf("Synced the objects of namespace '%s'", namespace)
+}
+
+// Hand the objects matching a function to their handlers again, or as deleted
+// if their namespace is not allowed by the filter
+func (s *namespaceSources) resyncMatching(match func(metav1.Object) bool) {
+	s.mu.Lock()
+	sources := append([]namespaceSource(nil), s.sources...)
+	s.mu.Unlock()
+
+	for _, source := range sources {
+		for _, obj := range source.informer.GetStore().List() {
+			o, ok := obj.(metav1.Object)
+			if !ok || !match(o) {
+				continue
+			}
+			if s.filter == nil || s.filter.allows(o.GetNamespace()) {
+				source.handler.OnAdd(obj)
+			} else {
+				source.handler.OnDelete(obj)
+			}
+		}
+	}
+}
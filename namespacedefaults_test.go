@@ -0,0 +1,201 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNamespaceDefaults(t *testing.T) {
+	const p = DefaultAnnotationPrefix
+	hosts := []string{"app.example.com", "*.example.com"}
+
+	tests := []struct {
+		name   string
+		nsAnn  map[string]string
+		ann    map[string]string
+		client *staticClient
+		want   *staticClient
+		// Whether clients are registered at all
+		disabled bool
+		err      string
+	}{
+		{
+			name:   "no defaults",
+			client: &staticClient{Id: "app", RedirectURIs: []string{"https://app.example.com/callback"}},
+			want:   &staticClient{Id: "app", RedirectURIs: []string{"https://app.example.com/callback"}},
+		},
+		{
+			name: "namespace defaults",
+			nsAnn: map[string]string{
+				p + "-callback-path": "oauth2/callback",
+				p + "-logo-url":      "https://example.com/team.png",
+				p + "-trusted-peers": "cli, ,web",
+				p + "-endpoints":     "eu",
+			},
+			client: &staticClient{Id: "app"},
+			want: &staticClient{
+				Id:           "app",
+				RedirectURIs: []string{"https://app.example.com/oauth2/callback"},
+				LogoURL:      "https://example.com/team.png",
+				TrustedPeers: []string{"cli", "web"},
+				Endpoints:    []string{"eu"},
+			},
+		},
+		{
+			name: "object annotations win",
+			nsAnn: map[string]string{
+				p + "-callback-path": "/oauth2/callback",
+				p + "-logo-url":      "https://example.com/team.png",
+				p + "-trusted-peers": "cli",
+			},
+			ann: map[string]string{
+				p + "-callback-path": "/login",
+				p + "-logo-url":      "https://example.com/app.png",
+				p + "-trusted-peers": "web",
+			},
+			client: &staticClient{Id: "app"},
+			want: &staticClient{
+				Id:           "app",
+				RedirectURIs: []string{"https://app.example.com/login"},
+				LogoURL:      "https://example.com/app.png",
+				TrustedPeers: []string{"web"},
+			},
+		},
+		{
+			name:  "client attributes win",
+			nsAnn: map[string]string{p + "-callback-path": "/oauth2/callback", p + "-trusted-peers": "cli"},
+			client: &staticClient{
+				Id:           "app",
+				RedirectURIs: []string{"https://app.example.com/callback"},
+				TrustedPeers: []string{"web"},
+			},
+			want: &staticClient{
+				Id:           "app",
+				RedirectURIs: []string{"https://app.example.com/callback"},
+				TrustedPeers: []string{"web"},
+			},
+		},
+		{
+			name:     "disabled by namespace",
+			nsAnn:    map[string]string{p + "-enabled": "false"},
+			disabled: true,
+		},
+		{
+			name:   "enabled by object",
+			nsAnn:  map[string]string{p + "-enabled": "false"},
+			ann:    map[string]string{p + "-enabled": "true"},
+			client: &staticClient{Id: "app"},
+			want:   &staticClient{Id: "app"},
+		},
+		{
+			name:  "invalid enabled",
+			nsAnn: map[string]string{p + "-enabled": "maybe"},
+			err:   "invalid namespace annotation '" + p + "-enabled'",
+		},
+		{
+			name:  "client id prefix from namespace only",
+			nsAnn: map[string]string{p + "-client-id-prefix": "team-a-"},
+			ann:   map[string]string{p + "-client-id-prefix": "other-"},
+			client: &staticClient{
+				Id:           "app",
+				RedirectURIs: []string{"https://app.example.com/callback"},
+				TrustedPeers: []string{"cli"},
+			},
+			want: &staticClient{
+				Id:           "team-a-app",
+				RedirectURIs: []string{"https://app.example.com/callback"},
+				TrustedPeers: []string{"team-a-cli"},
+			},
+		},
+		{
+			name:   "allowed host",
+			nsAnn:  map[string]string{p + "-allowed-hosts": "*.example.com"},
+			client: &staticClient{Id: "app", RedirectURIs: []string{"https://app.example.com/callback"}},
+			want:   &staticClient{Id: "app", RedirectURIs: []string{"https://app.example.com/callback"}},
+		},
+		{
+			name:   "host not allowed",
+			nsAnn:  map[string]string{p + "-allowed-hosts": "*.team-a.example.com"},
+			client: &staticClient{Id: "app", RedirectURIs: []string{"https://app.example.com/callback"}},
+			err:    "client 'app': redirect host 'app.example.com' is not allowed in the namespace",
+		},
+		{
+			name:   "allowed hosts from namespace only",
+			nsAnn:  map[string]string{p + "-allowed-hosts": "*.team-a.example.com"},
+			ann:    map[string]string{p + "-allowed-hosts": "*"},
+			client: &staticClient{Id: "app", RedirectURIs: []string{"https://app.example.com/callback"}},
+			err:    "is not allowed in the namespace",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := newNamespaceDefaults(tt.nsAnn, tt.ann)
+			if err == nil {
+				if d.Enabled == tt.disabled {
+					t.Errorf("expected enabled %v, got %v", !tt.disabled, d.Enabled)
+				}
+				err = d.apply([]*staticClient{tt.client}, "https", hosts)
+			}
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tt.client, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, tt.client)
+			}
+		})
+	}
+}
+
+func TestNamespaceDefaultsChanged(t *testing.T) {
+	const p = DefaultAnnotationPrefix
+	namespace := func(ann map[string]string) *v1.Namespace {
+		return &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Annotations: ann}}
+	}
+
+	tests := []struct {
+		name     string
+		old, new map[string]string
+		want     bool
+	}{
+		{
+			name: "other annotation",
+			old:  map[string]string{"owner": "a"},
+			new:  map[string]string{"owner": "b"},
+		},
+		{
+			name: "default changed",
+			old:  map[string]string{p + "-callback-path": "/callback"},
+			new:  map[string]string{p + "-callback-path": "/login"},
+			want: true,
+		},
+		{
+			name: "default added",
+			new:  map[string]string{p + "-enabled": "false"},
+			want: true,
+		},
+		{
+			name: "default removed",
+			old:  map[string]string{p + "-client-id-prefix": "team-a-"},
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := namespaceDefaultsChanged(namespace(tt.old), namespace(tt.new)); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
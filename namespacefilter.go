@@ -0,0 +1,93 @@
+package main
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Restricts the namespaces whose objects define clients
+type namespaceFilter struct {
+	// Namespaces to watch, all if empty
+	include []string
+	// Namespaces to ignore
+	exclude map[string]bool
+	// Selector the namespace labels must match, if any
+	selector labels.Selector
+	// Namespaces, to match the selector against
+	namespaces cache.Store
+}
+
+// Return a new filter from the --namespaces, --exclude-namespaces and
+// --namespace-selector flags
+func newNamespaceFilter(include []string, exclude []string, selector string) (*namespaceFilter, error) {
+	f := &namespaceFilter{
+		include: include,
+		exclude: make(map[string]bool),
+	}
+	for _, name := range exclude {
+		f.exclude[name] = true
+	}
+	if selector != "" {
+		s, err := labels.Parse(selector)
+		if err != nil {
+			return nil, err
+		}
+		f.selector = s
+	}
+	return f, nil
+}
+
+// Return the namespaces to create informers for. A single informer watches all
+// namespaces unless a list is given, so that Roles in those namespaces are enough
+func (f *namespaceFilter) watched() []string {
+	if len(f.include) == 0 {
+		return []string{v1.NamespaceAll}
+	}
+	var namespaces []string
+	for _, name := range f.include {
+		if !f.exclude[name] {
+			namespaces = append(namespaces, name)
+		}
+	}
+	return namespaces
+}
+
+// Return whether Namespaces need to be read to apply the filter
+func (f *namespaceFilter) needsNamespaces() bool {
+	return f.selector != nil
+}
+
+// Return whether the objects of a namespace define clients
+func (f *namespaceFilter) allows(name string) bool {
+	if f.exclude[name] {
+		return false
+	}
+	if f.selector == nil {
+		return true
+	}
+	if f.namespaces == nil {
+		return false
+	}
+	obj, exists, err := f.namespaces.GetByKey(name)
+	if err != nil || !exists {
+		return false
+	}
+	namespace, ok := obj.(*v1.Namespace)
+	return ok && f.selector.Matches(labels.Set(namespace.Labels))
+}
+
+// Return whether an object is in a namespace whose objects define clients
+func (f *namespaceFilter) allowsObject(obj interface{}) bool {
+	o, ok := deletedObject(obj).(metav1.Object)
+	return ok && f.allows(o.GetNamespace())
+}
+
+// Wrap a handler to only get the objects of allowed namespaces
+func (f *namespaceFilter) handler(h cache.ResourceEventHandler) cache.ResourceEventHandler {
+	return cache.FilteringResourceEventHandler{
+		FilterFunc: f.allowsObject,
+		Handler:    h,
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestNamespaceFilter(t *testing.T) {
+	namespaces := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	for name, team := range map[string]string{"team-a": "a", "team-b": "b", "unlabelled": ""} {
+		ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if team != "" {
+			ns.Labels = map[string]string{"team": team}
+		}
+		if err := namespaces.Add(ns); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		include  []string
+		exclude  []string
+		selector string
+		// Namespaces to create informers for
+		watched []string
+		// Whether each namespace is allowed
+		allows map[string]bool
+		err    string
+	}{
+		{
+			name:    "all namespaces",
+			watched: []string{v1.NamespaceAll},
+			allows:  map[string]bool{"team-a": true, "team-b": true, "unknown": true},
+		},
+		{
+			name:    "included namespaces",
+			include: []string{"team-a", "team-b"},
+			watched: []string{"team-a", "team-b"},
+			allows:  map[string]bool{"team-a": true, "team-b": true},
+		},
+		{
+			name:    "excluded from all",
+			exclude: []string{"team-b"},
+			watched: []string{v1.NamespaceAll},
+			allows:  map[string]bool{"team-a": true, "team-b": false},
+		},
+		{
+			name:    "excluded from included",
+			include: []string{"team-a", "team-b"},
+			exclude: []string{"team-b"},
+			watched: []string{"team-a"},
+			allows:  map[string]bool{"team-a": true, "team-b": false},
+		},
+		{
+			name:     "selector",
+			selector: "team=a",
+			watched:  []string{v1.NamespaceAll},
+			allows:   map[string]bool{"team-a": true, "team-b": false, "unlabelled": false, "unknown": false},
+		},
+		{
+			name:     "selector on existence",
+			selector: "team",
+			watched:  []string{v1.NamespaceAll},
+			allows:   map[string]bool{"team-a": true, "team-b": true, "unlabelled": false},
+		},
+		{
+			name:     "selector and exclude",
+			exclude:  []string{"team-a"},
+			selector: "team in (a,b)",
+			watched:  []string{v1.NamespaceAll},
+			allows:   map[string]bool{"team-a": false, "team-b": true},
+		},
+		{
+			name:     "invalid selector",
+			selector: "team in a",
+			err:      "unable to parse requirement",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newNamespaceFilter(tt.include, tt.exclude, tt.selector)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.needsNamespaces() {
+				f.namespaces = namespaces
+			}
+
+			if watched := f.watched(); !reflect.DeepEqual(watched, tt.watched) {
+				t.Errorf("expected to watch %v, got %v", tt.watched, watched)
+			}
+			for name, want := range tt.allows {
+				if got := f.allows(name); got != want {
+					t.Errorf("namespace %s: expected allowed %v, got %v", name, want, got)
+				}
+				obj := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: name, Name: "clients"}}
+				if got := f.allowsObject(cache.DeletedFinalStateUnknown{Key: name + "/clients", Obj: obj}); got != want {
+					t.Errorf("deleted object in namespace %s: expected allowed %v, got %v", name, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestNamespaceFilterWithoutNamespaces(t *testing.T) {
+	f, err := newNamespaceFilter(nil, nil, "team=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is allowed until Namespaces are known
+	if f.allows("team-a") {
+		t.Errorf("expected namespace team-a not to be allowed")
+	}
+}
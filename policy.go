@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// ConfigMap data key holding the policy
+const PolicyConfigMapKey = "policy.yaml"
+
+// Cluster policy restricting the clients each namespace can register. A client
+// is allowed if any rule matching its namespace allows both its id and all its
+// redirect hosts. Clients of namespaces matching no rule are refused
+type policy struct {
+	Rules []*policyRule `json:"rules"`
+}
+
+type policyRule struct {
+	// Names of the namespaces the rule applies to
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Selector for the namespaces the rule applies to. Without namespaces and
+	// selector, the rule applies to all namespaces
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// Glob patterns for the allowed redirect URI hosts, all if unset
+	AllowedRedirectHosts []string `json:"allowedRedirectHosts,omitempty"`
+	// Glob patterns for the allowed client ids, all if unset
+	AllowedClientIDs []string `json:"allowedClientIDs,omitempty"`
+
+	selector labels.Selector
+}
+
+// Parse a YAML or JSON policy. An empty document or one without rules is an
+// error, refusing all clients takes an explicit empty list
+func parsePolicy(data []byte) (*policy, error) {
+	data, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(bytes.TrimSpace(data), []byte("null")) {
+		return nil, fmt.Errorf("empty policy")
+	}
+
+	p := &policy{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return nil, err
+	}
+	if p.Rules == nil {
+		return nil, fmt.Errorf("no rules, use 'rules: []' to refuse all clients")
+	}
+
+	for i, rule := range p.Rules {
+		if rule == nil {
+			return nil, fmt.Errorf("rule %d: empty", i+1)
+		}
+		rule.selector = labels.Everything()
+		if rule.NamespaceSelector != nil {
+			if rule.selector, err = metav1.LabelSelectorAsSelector(rule.NamespaceSelector); err != nil {
+				return nil, fmt.Errorf("rule %d: %s", i+1, err)
+			}
+		}
+		for _, pattern := range append(rule.AllowedRedirectHosts, rule.AllowedClientIDs...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rule %d: invalid pattern '%s'", i+1, pattern)
+			}
+		}
+	}
+	return p, nil
+}
+
+// Read a policy from a file
+func loadPolicyFile(policyPath string) (*policy, error) {
+	data, err := ioutil.ReadFile(policyPath)
+	if err != nil {
+		return nil, err
+	}
+	p, err := parsePolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy '%s': %s", policyPath, err)
+	}
+	return p, nil
+}
+
+// Read the policy of a ConfigMap
+func policyFromConfigMap(cm *v1.ConfigMap) (*policy, error) {
+	data, ok := cm.Data[PolicyConfigMapKey]
+	if !ok {
+		return nil, fmt.Errorf("no '%s' key", PolicyConfigMapKey)
+	}
+	return parsePolicy([]byte(data))
+}
+
+// Check whether a client is allowed in a namespace
+func (p *policy) check(namespace *v1.Namespace, client *staticClient) error {
+	var hosts []string
+	for _, uri := range client.RedirectURIs {
+		if u, err := url.Parse(uri); err == nil {
+			hosts = append(hosts, strings.ToLower(u.Hostname()))
+		}
+	}
+
+	var err error
+	matched := false
+	for _, rule := range p.Rules {
+		if !rule.appliesTo(namespace) {
+			continue
+		}
+		matched = true
+
+		if !matchAny(rule.AllowedClientIDs, client.Id) {
+			err = fmt.Errorf("client id '%s' is not allowed in namespace '%s'", client.Id, namespace.Name)
+			continue
+		}
+		if host := firstUnmatched(rule.AllowedRedirectHosts, hosts); host != "" {
+			err = fmt.Errorf("redirect host '%s' is not allowed in namespace '%s'", host, namespace.Name)
+			continue
+		}
+		return nil
+	}
+
+	if !matched {
+		return fmt.Errorf("no policy rule for namespace '%s'", namespace.Name)
+	}
+	return err
+}
+
+// Return whether a rule applies to a namespace
+func (rule *policyRule) appliesTo(namespace *v1.Namespace) bool {
+	if len(rule.Namespaces) > 0 {
+		found := false
+		for _, name := range rule.Namespaces {
+			if name == namespace.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return rule.selector.Matches(labels.Set(namespace.Labels))
+}
+
+// Return whether a value matches any of the patterns, or there are no patterns
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(value)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the first value matching none of the patterns, or ""
+func firstUnmatched(patterns []string, values []string) string {
+	for _, value := range values {
+		if !matchAny(patterns, value) {
+			return value
+		}
+	}
+	return ""
+}
+
+// Resource handler loading the policy from a ConfigMap
+type PolicyClient struct {
+	reconciler *reconciler
+}
+
+func NewPolicyClient(r *reconciler) *PolicyClient {
+	return &PolicyClient{
+		reconciler: r,
+	}
+}
+
+// Handle policy ConfigMap creation
+func (c *PolicyClient) OnAdd(obj interface{}) {
+	o, ok := obj.(*v1.ConfigMap)
+	if !ok {
+		log.Warnf("Got an unexpected, unsupported, object. Not an ConfigMap")
+		return
+	}
+
+	p, err := policyFromConfigMap(o)
+	if err != nil {
+		log.Errorf("Invalid policy in ConfigMap '%s' from namespace '%s', keeping the current one - %s", o.Name, o.Namespace, err)
+		c.reconciler.recorder.Eventf(o, v1.EventTypeWarning, "InvalidPolicy", "Policy not loaded: %s", err)
+		return
+	}
+
+	log.Infof("Loaded policy from ConfigMap '%s' from namespace '%s'", o.Name, o.Namespace)
+	c.reconciler.setPolicy(p)
+}
+
+// Handle policy ConfigMap update
+func (c *PolicyClient) OnUpdate(oldObj, newObj interface{}) {
+	oldCm, ok := oldObj.(*v1.ConfigMap)
+	newCm, ok2 := newObj.(*v1.ConfigMap)
+	if ok && ok2 && oldCm.ResourceVersion == newCm.ResourceVersion {
+		return
+	}
+	c.OnAdd(newObj)
+}
+
+// Handle policy ConfigMap deletion. The current policy stays in force, rather
+// than letting every namespace register any client
+func (c *PolicyClient) OnDelete(obj interface{}) {
+	log.Warnf("Policy ConfigMap deleted, keeping the current policy")
+}
+
+// Resource handler syncing the clients of a namespace when its labels or
+// default annotations change
+type NamespaceClient struct {
+	reconciler *reconciler
+	sources    *namespaceSources
+}
+
+func NewNamespaceClient(r *reconciler, sources *namespaceSources) *NamespaceClient {
+	return &NamespaceClient{
+		reconciler: r,
+		sources:    sources,
+	}
+}
+
+func (c *NamespaceClient) OnAdd(obj interface{}) {}
+
+// Handle Namespace update event
+func (c *NamespaceClient) OnUpdate(oldObj, newObj interface{}) {
+	oldNs, ok := oldObj.(*v1.Namespace)
+	if !ok {
+		return
+	}
+	newNs, ok := newObj.(*v1.Namespace)
+	if !ok {
+		return
+	}
+
+	labelsChanged := !labels.Equals(oldNs.Labels, newNs.Labels)
+	if namespaceDefaultsChanged(oldNs, newNs) || (labelsChanged && c.sources.filter != nil && c.sources.filter.needsNamespaces()) {
+		// Also checks the clients against the policy
+		log.Infof("Namespace '%s' changed, syncing its clients", newNs.Name)
+		c.sources.resync(newNs.Name)
+		return
+	}
+	if !labelsChanged {
+		return
+	}
+
+	log.Infof("Labels of namespace '%s' changed, syncing its clients", newNs.Name)
+	c.reconciler.syncNamespace(newNs.Name)
+}
+
+func (c *NamespaceClient) OnDelete(obj interface{}) {}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		err    string
+	}{
+		{
+			name:   "valid",
+			policy: "rules:\n- namespaces: [team-a]\n  allowedClientIDs: [\"team-a-*\"]\n",
+		},
+		{
+			name:   "refusing all clients",
+			policy: "rules: []\n",
+		},
+		{
+			name:   "empty",
+			policy: " \n",
+			err:    "empty policy",
+		},
+		{
+			name:   "comments only",
+			policy: "# rules: []\n",
+			err:    "empty policy",
+		},
+		{
+			name:   "no rules",
+			policy: "{}\n",
+			err:    "no rules",
+		},
+		{
+			name:   "null rules",
+			policy: "rules:\n",
+			err:    "no rules",
+		},
+		{
+			name:   "unknown field",
+			policy: "rules:\n- namespace: team-a\n",
+			err:    "unknown field",
+		},
+		{
+			name:   "empty rule",
+			policy: "rules:\n- null\n",
+			err:    "rule 1: empty",
+		},
+		{
+			name:   "invalid selector",
+			policy: "rules:\n- namespaceSelector:\n    matchExpressions:\n    - {key: team, operator: Bad}\n",
+			err:    "rule 1",
+		},
+		{
+			name:   "invalid pattern",
+			policy: "rules:\n- {}\n- allowedRedirectHosts: [\"[\"]\n",
+			err:    "rule 2: invalid pattern '['",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parsePolicy([]byte(tt.policy))
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestPolicyFromConfigMap(t *testing.T) {
+	tests := []struct {
+		name string
+		data map[string]string
+		err  string
+	}{
+		{
+			name: "valid",
+			data: map[string]string{PolicyConfigMapKey: "rules: []\n"},
+		},
+		{
+			name: "missing key",
+			data: map[string]string{"policy.yml": "rules: []\n"},
+			err:  "no 'policy.yaml' key",
+		},
+		{
+			name: "no data",
+			err:  "no 'policy.yaml' key",
+		},
+		{
+			name: "empty key",
+			data: map[string]string{PolicyConfigMapKey: ""},
+			err:  "empty policy",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := policyFromConfigMap(&v1.ConfigMap{Data: tt.data})
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	p, err := parsePolicy([]byte(`
+rules:
+# By name
+- namespaces: [team-a]
+  allowedClientIDs: ["team-a-*"]
+  allowedRedirectHosts: ["*.team-a.example.com"]
+# By selector
+- namespaceSelector:
+    matchLabels:
+      tier: partner
+  allowedRedirectHosts: ["*.partners.example.com"]
+# By name and selector
+- namespaces: [team-b, team-c]
+  namespaceSelector:
+    matchLabels:
+      trusted: "true"
+# Several rules for a namespace, any of them allows
+- namespaces: [team-a]
+  allowedClientIDs: [shared]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	anyNamespace, err := parsePolicy([]byte("rules:\n- allowedRedirectHosts: [\"*.example.com\"]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	none, err := parsePolicy([]byte("rules: []\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	namespace := func(name string, labels map[string]string) *v1.Namespace {
+		return &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+	}
+	client := func(id string, uris ...string) *staticClient {
+		return &staticClient{Id: id, RedirectURIs: uris}
+	}
+
+	tests := []struct {
+		name      string
+		policy    *policy
+		namespace *v1.Namespace
+		client    *staticClient
+		// Part of the error, if the client is refused
+		err string
+	}{
+		{
+			name:      "allowed by name",
+			policy:    p,
+			namespace: namespace("team-a", nil),
+			client:    client("team-a-app", "https://app.team-a.example.com/callback"),
+		},
+		{
+			name:      "patterns ignore case",
+			policy:    p,
+			namespace: namespace("team-a", nil),
+			client:    client("Team-A-App", "https://APP.team-a.example.com/callback"),
+		},
+		{
+			name:      "client id refused",
+			policy:    p,
+			namespace: namespace("team-a", nil),
+			client:    client("team-b-app", "https://app.team-a.example.com/callback"),
+			err:       "client id 'team-b-app' is not allowed in namespace 'team-a'",
+		},
+		{
+			name:      "redirect host refused",
+			policy:    p,
+			namespace: namespace("team-a", nil),
+			client:    client("team-a-app", "https://app.team-a.example.com/callback", "https://evil.example.com/callback"),
+			// Reported by the last rule of the namespace
+			err: "is not allowed in namespace 'team-a'",
+		},
+		{
+			name:      "allowed by another rule",
+			policy:    p,
+			namespace: namespace("team-a", nil),
+			client:    client("shared", "https://anywhere.example.com/callback"),
+		},
+		{
+			name:      "allowed by selector",
+			policy:    p,
+			namespace: namespace("acme", map[string]string{"tier": "partner"}),
+			client:    client("acme", "https://acme.partners.example.com/callback"),
+		},
+		{
+			name:      "selector not matching",
+			policy:    p,
+			namespace: namespace("acme", map[string]string{"tier": "internal"}),
+			client:    client("acme", "https://acme.partners.example.com/callback"),
+			err:       "no policy rule for namespace 'acme'",
+		},
+		{
+			name:      "name and selector matching",
+			policy:    p,
+			namespace: namespace("team-b", map[string]string{"trusted": "true"}),
+			client:    client("anything", "https://anywhere.example.org/callback"),
+		},
+		{
+			name:      "name matching without selector",
+			policy:    p,
+			namespace: namespace("team-b", nil),
+			client:    client("anything", "https://anywhere.example.org/callback"),
+			err:       "no policy rule for namespace 'team-b'",
+		},
+		{
+			name:      "selector matching without name",
+			policy:    p,
+			namespace: namespace("team-d", map[string]string{"trusted": "true"}),
+			client:    client("anything", "https://anywhere.example.org/callback"),
+			err:       "no policy rule for namespace 'team-d'",
+		},
+		{
+			name:      "rule without namespaces applies to all",
+			policy:    anyNamespace,
+			namespace: namespace("whatever", nil),
+			client:    client("anything", "https://app.example.com/callback"),
+		},
+		{
+			name:      "rule without namespaces still checks hosts",
+			policy:    anyNamespace,
+			namespace: namespace("whatever", nil),
+			client:    client("anything", "https://app.example.org/callback"),
+			err:       "redirect host 'app.example.org' is not allowed",
+		},
+		{
+			name:      "no rule means refused",
+			policy:    none,
+			namespace: namespace("team-a", nil),
+			client:    client("team-a-app", "https://app.team-a.example.com/callback"),
+			err:       "no policy rule for namespace 'team-a'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.check(tt.namespace, tt.client)
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
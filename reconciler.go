@@ -0,0 +1,593 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// Identifies a watched object defining Dex clients
+type objectRef struct {
+	Kind      string
+	Resource  schema.GroupVersionResource
+	Namespace string
+	Name      string
+	UID       types.UID
+	Created   time.Time
+}
+
+// Return the reference to a watched object
+func newObjectRef(kind string, resource schema.GroupVersionResource, o metav1.Object) objectRef {
+	return objectRef{
+		Kind:      kind,
+		Resource:  resource,
+		Namespace: o.GetNamespace(),
+		Name:      o.GetName(),
+		UID:       o.GetUID(),
+		Created:   o.GetCreationTimestamp().Time,
+	}
+}
+
+// Key identifying the object across API versions and re-creations
+func (ref objectRef) key() string {
+	return fmt.Sprintf("%s/%s/%s", ref.Kind, ref.Namespace, ref.Name)
+}
+
+// Reference to the object, to record events on
+func (ref objectRef) reference() *v1.ObjectReference {
+	return &v1.ObjectReference{
+		Kind:       ref.Kind,
+		APIVersion: ref.Resource.GroupVersion().String(),
+		Namespace:  ref.Namespace,
+		Name:       ref.Name,
+		UID:        ref.UID,
+	}
+}
+
+// Time allowed for each backend call
+const BackendTimeout = 30 * time.Second
+
+// Interval between retries of the clients the backend failed to sync, doubled
+// on each failure of a client up to RetryMaxBackoff
+const (
+	RetryInterval   = 10 * time.Second
+	RetryMaxBackoff = 5 * time.Minute
+)
+
+// Ways to resolve several objects defining the same client id
+const (
+	// The oldest object keeps the client
+	CollisionOldestWins = "oldest-wins"
+	// The object which defined the client first keeps it. Among the objects
+	// listed on start, the oldest one
+	CollisionReject = "reject"
+	// The redirect URIs of all objects agreeing on the secret are merged
+	CollisionMerge = "merge"
+)
+
+// Clients of a watched object
+type objectState struct {
+	ref objectRef
+	// Clients defined by the object
+	desired []*staticClient
+	// Clients allowed by the policy, by client id
+	claimed map[string]*staticClient
+	// Order in which the object claimed each client id, 0 for claims made
+	// while listing the objects on start
+	claimOrder map[string]uint64
+}
+
+// A client as registered in the backend
+type registration struct {
+	client *staticClient
+	// Object the client was registered for, for logging
+	ref objectRef
+	// Keys of the objects whose client was registered, merged ones included
+	owners map[string]bool
+}
+
+// A client id the backend failed to sync
+type failure struct {
+	// Object whose change triggered the sync
+	ref objectRef
+	// Failed attempts so far, and time of the next one
+	attempts int
+	next     time.Time
+}
+
+// Lock serialising the backend calls for a client id, with the number of
+// callers holding or waiting for it
+type clientLock struct {
+	sync.Mutex
+	users int
+}
+
+// Keeps the backend clients in line with the objects defining them. Each object can
+// define several clients, which are created, updated and deleted independently.
+// Several objects defining the same client id are resolved by the collision
+// policy, and a client is only deleted once no object defines it anymore.
+// Backend calls are made without holding the reconciler lock, one at a time
+// for each client id
+type reconciler struct {
+	backend         Backend
+	recorder        record.EventRecorder
+	dynamicClient   dynamic.Interface
+	collisionPolicy string
+
+	mu sync.Mutex
+	// Clients of each object, by object key
+	objects map[string]*objectState
+	// Objects claiming each client id, by object key
+	claims map[string]map[string]*objectState
+	// Clients registered in the backend, by client id
+	registered map[string]*registration
+	// Client ids the backend failed to sync, retried in the background
+	failed map[string]*failure
+	// Locks of the client ids being synced
+	locks map[string]*clientLock
+	// Counter ordering the claims
+	claimCounter uint64
+	// Whether the objects listed on start have all been applied
+	listed bool
+	// Policy restricting the clients of each namespace, if any
+	policy *policy
+	// Namespaces, to match the policy namespace selectors against
+	namespaces cache.Store
+}
+
+// Return a new reconciler managing clients in the given backend,
+// resolving client id collisions with the given policy, reporting problems as
+// events with the given recorder and writing back to objects with the given
+// dynamic client
+func newReconciler(backend Backend, recorder record.EventRecorder, dynamicClient dynamic.Interface, collisionPolicy string) *reconciler {
+	return &reconciler{
+		backend:         backend,
+		recorder:        recorder,
+		dynamicClient:   dynamicClient,
+		collisionPolicy: collisionPolicy,
+		objects:         make(map[string]*objectState),
+		claims:          make(map[string]map[string]*objectState),
+		registered:      make(map[string]*registration),
+		failed:          make(map[string]*failure),
+		locks:           make(map[string]*clientLock),
+	}
+}
+
+// Set the clients defined by an object. Clients are created, updated or
+// deleted in the backend for whatever changed since the object was last applied.
+// Returns the ids of the clients registered for the object, in order
+func (r *reconciler) apply(ref objectRef, clients []*staticClient) []string {
+	r.mu.Lock()
+	state, ok := r.objects[ref.key()]
+	if !ok {
+		if len(clients) == 0 {
+			r.mu.Unlock()
+			return nil
+		}
+		state = &objectState{
+			claimed:    make(map[string]*staticClient),
+			claimOrder: make(map[string]uint64),
+		}
+		r.objects[ref.key()] = state
+	}
+	state.ref = ref
+	state.desired = clients
+
+	ids := r.claim(state)
+	if len(state.desired) == 0 && len(state.claimed) == 0 {
+		delete(r.objects, ref.key())
+	}
+	r.mu.Unlock()
+
+	r.syncClients(ids)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var registered []string
+	for _, client := range clients {
+		if reg, ok := r.registered[client.Id]; ok && reg.owners[ref.key()] {
+			registered = append(registered, client.Id)
+		}
+	}
+	return registered
+}
+
+// Claim the allowed clients of an object and release the ones it no longer
+// defines or which are no longer allowed. Returns the client ids involved,
+// with the object as the trigger of their sync. Called with the lock held
+func (r *reconciler) claim(state *objectState) map[string]objectRef {
+	ref := state.ref
+
+	ids := make(map[string]bool)
+	for id := range state.claimed {
+		ids[id] = true
+	}
+
+	claimed := make(map[string]*staticClient)
+	for _, client := range state.desired {
+		if err := r.checkPolicy(ref, client); err != nil {
+			log.Warnf("Ignoring client '%s' of %s '%s' from namespace '%s' - %s", client.Id, ref.Kind, ref.Name, ref.Namespace, err)
+			r.recorder.Eventf(ref.reference(), v1.EventTypeWarning, "PolicyViolation", "Dex client '%s' not registered: %s", client.Id, err)
+			continue
+		}
+		claimed[client.Id] = client
+		ids[client.Id] = true
+	}
+
+	for id := range ids {
+		owners, ok := r.claims[id]
+		if !ok {
+			owners = make(map[string]*objectState)
+			r.claims[id] = owners
+		}
+		if _, ok := claimed[id]; ok {
+			if _, ok := owners[ref.key()]; !ok && r.listed {
+				r.claimCounter++
+				state.claimOrder[id] = r.claimCounter
+			}
+			owners[ref.key()] = state
+		} else {
+			delete(owners, ref.key())
+			delete(state.claimOrder, id)
+		}
+	}
+	state.claimed = claimed
+
+	triggers := make(map[string]objectRef)
+	for id := range ids {
+		triggers[id] = ref
+	}
+	return triggers
+}
+
+// Sync client ids, each triggered by a change of the given object
+func (r *reconciler) syncClients(triggers map[string]objectRef) {
+	ids := make([]string, 0, len(triggers))
+	for id := range triggers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		r.syncClient(id, triggers[id])
+	}
+}
+
+// Resolve the objects claiming a client id into the client to register, and
+// create, update or delete it in the backend accordingly. The claims are read
+// once the client id is locked, so the last sync of a client id applies the
+// latest claims
+func (r *reconciler) syncClient(id string, trigger objectRef) {
+	unlock := r.lockClient(id)
+	defer unlock()
+
+	r.mu.Lock()
+	owners := r.claims[id]
+	client, owner, contributors := r.resolve(id, owners)
+	if len(owners) == 0 {
+		delete(r.claims, id)
+	}
+	old, ok := r.registered[id]
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), BackendTimeout)
+	defer cancel()
+
+	switch {
+	case client == nil && !ok:
+		r.synced(id, nil)
+	case client == nil:
+		// The last object defining the client is gone
+		log.Infof("Deleting %s '%s' with static client '%s'", trigger.Kind, trigger.Name, id)
+		err := r.backend.Delete(ctx, old.client)
+		if errors.Is(err, errUnmanagedClient) {
+			// Taken over by someone else since registered, no longer ours
+			r.unmanaged(trigger, id, err)
+			r.synced(id, nil)
+			return
+		}
+		if err != nil {
+			// Kept registered, to delete it on the next try
+			r.backendFailed(trigger, fmt.Errorf("failed to delete client '%s': %s", id, err))
+			r.retryLater(id, trigger)
+			return
+		}
+		r.synced(id, nil)
+	default:
+		// Also done when nothing changed, to restore clients lost by the backend
+		log.Infof("Registering %s '%s' from namespace '%s' with static client '%s' at callback '%s'",
+			owner.Kind, owner.Name, owner.Namespace, id, strings.Join(client.RedirectURIs, ","))
+		err := r.backend.Ensure(ctx, client)
+		if errors.Is(err, errUnmanagedClient) {
+			// Not retried, the resync of the object tries again
+			r.unmanaged(owner, id, err)
+			r.synced(id, nil)
+			return
+		}
+		if err != nil {
+			// The client registered before, if any, is left as it is
+			r.backendFailed(owner, fmt.Errorf("failed to register client '%s': %s", id, err))
+			r.retryLater(id, owner)
+			return
+		}
+		r.synced(id, &registration{client: client, ref: owner, owners: contributors})
+	}
+}
+
+// Lock a client id for its backend calls, returning the function unlocking it
+func (r *reconciler) lockClient(id string) func() {
+	r.mu.Lock()
+	l, ok := r.locks[id]
+	if !ok {
+		l = &clientLock{}
+		r.locks[id] = l
+	}
+	l.users++
+	r.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		r.mu.Lock()
+		if l.users--; l.users == 0 {
+			delete(r.locks, id)
+		}
+		r.mu.Unlock()
+	}
+}
+
+// Record the client registered for a client id, nil if none, once synced
+func (r *reconciler) synced(id string, reg *registration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if reg != nil {
+		r.registered[id] = reg
+	} else {
+		delete(r.registered, id)
+	}
+	delete(r.failed, id)
+}
+
+// Schedule a retry of a client id the backend failed to sync, backing off
+// with each failure
+func (r *reconciler) retryLater(id string, trigger objectRef) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, ok := r.failed[id]
+	if !ok {
+		f = &failure{}
+		r.failed[id] = f
+	}
+	f.ref = trigger
+	f.attempts++
+
+	backoff := RetryInterval
+	for i := 1; i < f.attempts && backoff < RetryMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > RetryMaxBackoff {
+		backoff = RetryMaxBackoff
+	}
+	f.next = time.Now().Add(backoff)
+}
+
+// Retry the client ids the backend failed to sync until stop is closed. Clients
+// of objects still around are also retried by their resync, this catches the
+// deletions
+func (r *reconciler) runRetries(stop <-chan struct{}) {
+	ticker := time.NewTicker(RetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			r.retryFailed(now)
+		}
+	}
+}
+
+// Sync again the failed client ids whose retry is due
+func (r *reconciler) retryFailed(now time.Time) {
+	r.mu.Lock()
+	due := make(map[string]objectRef)
+	for id, f := range r.failed {
+		if !now.Before(f.next) {
+			due[id] = f.ref
+		}
+	}
+	r.mu.Unlock()
+
+	r.syncClients(due)
+}
+
+// Pick the client to register out of the objects claiming a client id, according
+// to the collision policy, and report the conflict to the objects left out.
+// Objects opting in to a shared client have their redirect URIs merged, as long
+// as they agree on the secret, whatever the policy. Returns nil if no object
+// claims the id, along with the object registered and the keys of all the
+// objects whose client made it in
+func (r *reconciler) resolve(id string, owners map[string]*objectState) (*staticClient, objectRef, map[string]bool) {
+	if len(owners) == 0 {
+		return nil, objectRef{}, nil
+	}
+
+	states := make([]*objectState, 0, len(owners))
+	for _, state := range owners {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		a, b := states[i], states[j]
+		if r.collisionPolicy == CollisionReject && a.claimOrder[id] != b.claimOrder[id] {
+			return a.claimOrder[id] < b.claimOrder[id]
+		}
+		if !a.ref.Created.Equal(b.ref.Created) {
+			return a.ref.Created.Before(b.ref.Created)
+		}
+		return a.ref.key() < b.ref.key()
+	})
+
+	winner := states[0]
+	client := winner.claimed[id]
+	contributors := map[string]bool{winner.ref.key(): true}
+
+	for _, state := range states[1:] {
+		ref := state.ref
+		other := state.claimed[id]
+
+		if r.collisionPolicy == CollisionMerge || (client.Shared && other.Shared) {
+			if other.Secret == client.Secret && other.Public == client.Public {
+				client = mergeClients(client, other)
+				contributors[ref.key()] = true
+				continue
+			}
+
+			log.Warnf("Ignoring client '%s' of %s '%s' from namespace '%s' - secret differs from %s '%s' from namespace '%s' sharing it",
+				id, ref.Kind, ref.Name, ref.Namespace, winner.ref.Kind, winner.ref.Name, winner.ref.Namespace)
+			r.recorder.Eventf(ref.reference(), v1.EventTypeWarning, "ClientSecretMismatch", "Dex client '%s' not shared: secret differs from %s %s/%s",
+				id, winner.ref.Kind, winner.ref.Namespace, winner.ref.Name)
+			continue
+		}
+
+		log.Warnf("Ignoring client '%s' of %s '%s' from namespace '%s' - already defined by %s '%s' from namespace '%s'",
+			id, ref.Kind, ref.Name, ref.Namespace, winner.ref.Kind, winner.ref.Name, winner.ref.Namespace)
+		r.recorder.Eventf(ref.reference(), v1.EventTypeWarning, "ClientIDConflict", "Dex client '%s' not registered: already defined by %s %s/%s",
+			id, winner.ref.Kind, winner.ref.Namespace, winner.ref.Name)
+	}
+
+	return client, winner.ref, contributors
+}
+
+// Return a copy of a client, with the redirect URIs and endpoints of another added
+func mergeClients(client, other *staticClient) *staticClient {
+	merged := *client
+	merged.RedirectURIs = append([]string(nil), client.RedirectURIs...)
+	merged.Endpoints = append([]string(nil), client.Endpoints...)
+	for _, name := range other.Endpoints {
+		if !contains(merged.Endpoints, name) {
+			merged.Endpoints = append(merged.Endpoints, name)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, uri := range merged.RedirectURIs {
+		seen[uri] = true
+	}
+	for _, uri := range other.RedirectURIs {
+		if !seen[uri] {
+			seen[uri] = true
+			merged.RedirectURIs = append(merged.RedirectURIs, uri)
+		}
+	}
+	return &merged
+}
+
+// Check a client of an object against the policy
+func (r *reconciler) checkPolicy(ref objectRef, client *staticClient) error {
+	if r.policy == nil {
+		return nil
+	}
+
+	var namespace *v1.Namespace
+	if r.namespaces != nil {
+		if obj, exists, err := r.namespaces.GetByKey(ref.Namespace); err == nil && exists {
+			namespace, _ = obj.(*v1.Namespace)
+		}
+	}
+	if namespace == nil {
+		namespace = &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ref.Namespace}}
+	}
+
+	return r.policy.check(namespace, client)
+}
+
+// Replace the policy, and sync the clients of every object against it
+func (r *reconciler) setPolicy(p *policy) {
+	r.mu.Lock()
+	r.policy = p
+	triggers := make(map[string]objectRef)
+	for _, state := range r.objects {
+		for id, ref := range r.claim(state) {
+			triggers[id] = ref
+		}
+	}
+	r.mu.Unlock()
+
+	r.syncClients(triggers)
+}
+
+// Mark the objects listed on start as all applied. Claims made until then are
+// ordered by the age of the objects rather than by the order they were listed
+// in, so that the reject collision policy keeps the same object across restarts
+func (r *reconciler) setListed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.listed = true
+}
+
+// Return whether a policy is in force
+func (r *reconciler) hasPolicy() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.policy != nil
+}
+
+// Sync the clients of every object in a namespace, after it changed
+func (r *reconciler) syncNamespace(namespace string) {
+	r.mu.Lock()
+	triggers := make(map[string]objectRef)
+	for _, state := range r.objects {
+		if state.ref.Namespace == namespace {
+			for id, ref := range r.claim(state) {
+				triggers[id] = ref
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	r.syncClients(triggers)
+}
+
+// Report an object whose clients can't be applied. Clients it defined before
+// are left as they are
+func (r *reconciler) reject(ref objectRef, err error) {
+	log.Warnf("Ignoring %s '%s' from namespace '%s' - %s", ref.Kind, ref.Name, ref.Namespace, err)
+	r.recorder.Eventf(ref.reference(), v1.EventTypeWarning, "InvalidClient", "Dex clients not registered: %s", err)
+}
+
+// Report an object whose client id is taken by a client the watcher doesn't
+// manage
+func (r *reconciler) unmanaged(ref objectRef, id string, err error) {
+	log.Warnf("Ignoring client '%s' of %s '%s' from namespace '%s' - %s", id, ref.Kind, ref.Name, ref.Namespace, err)
+	r.recorder.Eventf(ref.reference(), v1.EventTypeWarning, "ClientIDConflict", "Dex client '%s' not registered: %s", id, err)
+}
+
+// Report an object whose client the backend failed to sync. Unlike reject, the
+// client itself may be fine, and is retried
+func (r *reconciler) backendFailed(ref objectRef, err error) {
+	log.Warnf("Failed to sync a client of %s '%s' from namespace '%s', retrying - %s", ref.Kind, ref.Name, ref.Namespace, err)
+	r.recorder.Eventf(ref.reference(), v1.EventTypeWarning, "RegistrationFailed", "Dex client not synced, retrying: %s", err)
+}
+
+// Forget an object, deleting all the clients it defined
+func (r *reconciler) remove(ref objectRef) {
+	r.apply(ref, nil)
+}
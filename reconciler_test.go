@@ -0,0 +1,599 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+var testResource = schema.GroupVersionResource{Group: "networking.k8s.io", Version: "v1", Resource: "ingresses"}
+
+// Return a reconciler over a memory backend, recording events
+func newTestReconciler(policy string) (*reconciler, *memoryBackend, *record.FakeRecorder) {
+	backend := newMemoryBackend()
+	recorder := record.NewFakeRecorder(100)
+	return newReconciler(backend, recorder, nil, policy), backend, recorder
+}
+
+// Return a reference to an Ingress created at the given minute
+func testRef(namespace, name string, minute int) objectRef {
+	return objectRef{
+		Kind:      "Ingress",
+		Resource:  testResource,
+		Namespace: namespace,
+		Name:      name,
+		UID:       types.UID(namespace + "/" + name),
+		Created:   time.Date(2020, 1, 1, 0, minute, 0, 0, time.UTC),
+	}
+}
+
+func testClient(id string, uris ...string) *staticClient {
+	return &staticClient{Id: id, Secret: "secret", RedirectURIs: uris}
+}
+
+// Return the clients of the backend, by id
+func backendClients(t *testing.T, b Backend) map[string]*staticClient {
+	t.Helper()
+	list, err := b.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := make(map[string]*staticClient)
+	for _, client := range list {
+		clients[client.Id] = client
+	}
+	return clients
+}
+
+// Return the events recorded so far
+func recordedEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestReconcilerApply(t *testing.T) {
+	r, backend, _ := newTestReconciler(CollisionOldestWins)
+	ref := testRef("team-a", "app", 0)
+
+	r.apply(ref, []*staticClient{
+		testClient("a", "https://a.example.com/callback"),
+		testClient("b", "https://b.example.com/callback"),
+	})
+	clients := backendClients(t, backend)
+	if len(clients) != 2 || clients["a"] == nil || clients["b"] == nil {
+		t.Fatalf("expected clients a and b, got %v", clients)
+	}
+
+	// Update a, drop b, add c
+	r.apply(ref, []*staticClient{
+		testClient("a", "https://a.example.com/oauth2/callback"),
+		testClient("c", "https://c.example.com/callback"),
+	})
+	clients = backendClients(t, backend)
+	if len(clients) != 2 || clients["b"] != nil || clients["c"] == nil {
+		t.Fatalf("expected clients a and c, got %v", clients)
+	}
+	if got := clients["a"].RedirectURIs; !reflect.DeepEqual(got, []string{"https://a.example.com/oauth2/callback"}) {
+		t.Errorf("client a not updated, redirect URIs %v", got)
+	}
+
+	r.remove(ref)
+	if clients = backendClients(t, backend); len(clients) != 0 {
+		t.Fatalf("expected no clients, got %v", clients)
+	}
+	if len(r.objects) != 0 || len(r.claims) != 0 || len(r.registered) != 0 {
+		t.Errorf("state left after remove: %d objects, %d claims, %d registered", len(r.objects), len(r.claims), len(r.registered))
+	}
+}
+
+func TestReconcilerLastOwner(t *testing.T) {
+	r, backend, _ := newTestReconciler(CollisionMerge)
+	first := testRef("team-a", "first", 0)
+	second := testRef("team-a", "second", 1)
+
+	r.apply(first, []*staticClient{testClient("shared", "https://first.example.com/callback")})
+	r.apply(second, []*staticClient{testClient("shared", "https://second.example.com/callback")})
+	if got := backendClients(t, backend)["shared"]; got == nil || len(got.RedirectURIs) != 2 {
+		t.Fatalf("expected a merged client, got %v", got)
+	}
+
+	r.remove(first)
+	got := backendClients(t, backend)["shared"]
+	if got == nil {
+		t.Fatal("client deleted while an object still defines it")
+	}
+	if !reflect.DeepEqual(got.RedirectURIs, []string{"https://second.example.com/callback"}) {
+		t.Errorf("expected the redirect URIs of the remaining object, got %v", got.RedirectURIs)
+	}
+
+	r.remove(second)
+	if got := backendClients(t, backend); len(got) != 0 {
+		t.Fatalf("client not deleted with its last owner, got %v", got)
+	}
+}
+
+func TestReconcilerPolicy(t *testing.T) {
+	r, backend, recorder := newTestReconciler(CollisionOldestWins)
+	p, err := parsePolicy([]byte(`
+rules:
+- namespaces: [team-a]
+  allowedClientIDs: ["team-a-*"]
+  allowedRedirectHosts: ["*.team-a.example.com"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.setPolicy(p)
+
+	r.apply(testRef("team-a", "app", 0), []*staticClient{
+		testClient("team-a-app", "https://app.team-a.example.com/callback"),
+		testClient("other", "https://app.team-a.example.com/callback"),
+		testClient("team-a-evil", "https://evil.example.com/callback"),
+	})
+	r.apply(testRef("team-b", "app", 0), []*staticClient{
+		testClient("team-a-b", "https://app.team-a.example.com/callback"),
+	})
+
+	clients := backendClients(t, backend)
+	if len(clients) != 1 || clients["team-a-app"] == nil {
+		t.Fatalf("expected only team-a-app, got %v", clients)
+	}
+	events := recordedEvents(recorder)
+	if len(events) != 3 {
+		t.Fatalf("expected 3 policy events, got %v", events)
+	}
+	for _, event := range events {
+		if !strings.Contains(event, "PolicyViolation") {
+			t.Errorf("unexpected event %q", event)
+		}
+	}
+}
+
+func TestReconcilerRegisteredIDs(t *testing.T) {
+	r, _, _ := newTestReconciler(CollisionOldestWins)
+	p, err := parsePolicy([]byte("rules:\n- allowedClientIDs: [\"team-*\", shared, taken]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.setPolicy(p)
+
+	older := testRef("team-a", "older", 0)
+	if got := r.apply(older, []*staticClient{testClient("taken", "https://older/cb")}); !reflect.DeepEqual(got, []string{"taken"}) {
+		t.Fatalf("expected taken registered, got %v", got)
+	}
+	shared := testClient("shared", "https://older/cb")
+	shared.Shared = true
+	r.apply(older, []*staticClient{testClient("taken", "https://older/cb"), shared})
+
+	newer := testRef("team-a", "newer", 1)
+	newerShared := testClient("shared", "https://newer/cb")
+	newerShared.Shared = true
+	got := r.apply(newer, []*staticClient{
+		testClient("team-app", "https://newer/cb"),
+		testClient("refused", "https://newer/cb"),
+		testClient("taken", "https://newer/cb"),
+		newerShared,
+	})
+	if want := []string{"team-app", "shared"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v registered, got %v", want, got)
+	}
+}
+
+// Backend failing every call while failing is set
+type failingBackend struct {
+	*memoryBackend
+	failing bool
+}
+
+func (b *failingBackend) Ensure(ctx context.Context, client *staticClient) error {
+	if b.failing {
+		return errors.New("unavailable")
+	}
+	return b.memoryBackend.Ensure(ctx, client)
+}
+
+func (b *failingBackend) Delete(ctx context.Context, client *staticClient) error {
+	if b.failing {
+		return errors.New("unavailable")
+	}
+	return b.memoryBackend.Delete(ctx, client)
+}
+
+func TestReconcilerBackendError(t *testing.T) {
+	backend := &failingBackend{memoryBackend: newMemoryBackend(), failing: true}
+	recorder := record.NewFakeRecorder(100)
+	r := newReconciler(backend, recorder, nil, CollisionOldestWins)
+	ref := testRef("team-a", "app", 0)
+	other := testRef("team-a", "other", 0)
+
+	r.apply(ref, []*staticClient{testClient("a", "https://a.example.com/callback")})
+	if got := backendClients(t, backend); len(got) != 0 {
+		t.Fatalf("expected no clients, got %v", got)
+	}
+	if events := recordedEvents(recorder); len(events) != 1 || !strings.HasPrefix(events[0], "Warning RegistrationFailed ") ||
+		!strings.Contains(events[0], "failed to register client 'a'") {
+		t.Fatalf("expected a failure event, got %v", events)
+	}
+
+	// Retried on resync
+	backend.failing = false
+	r.apply(ref, []*staticClient{testClient("a", "https://a.example.com/callback")})
+	if got := backendClients(t, backend); got["a"] == nil {
+		t.Fatalf("client not registered on retry, got %v", got)
+	}
+
+	// A failed delete is retried in the background, backing off
+	backend.failing = true
+	r.remove(ref)
+	if got := backendClients(t, backend); got["a"] == nil {
+		t.Fatal("client deleted while the backend fails")
+	}
+	r.retryFailed(time.Now())
+	r.retryFailed(time.Now().Add(RetryMaxBackoff))
+	if f := r.failed["a"]; f == nil || f.attempts != 2 || time.Until(f.next) < RetryInterval*2-time.Second {
+		t.Fatalf("expected a retry backing off, got %+v", f)
+	}
+	backend.failing = false
+	r.apply(other, []*staticClient{testClient("b", "https://b.example.com/callback")})
+	if got := backendClients(t, backend); got["a"] == nil {
+		t.Fatal("failed delete retried on an unrelated change")
+	}
+	r.retryFailed(time.Now().Add(RetryMaxBackoff))
+	if got := backendClients(t, backend); got["a"] != nil || got["b"] == nil {
+		t.Fatalf("expected only client b, got %v", got)
+	}
+	if len(r.failed) != 0 {
+		t.Errorf("failed clients left: %v", r.failed)
+	}
+}
+
+// Backend holding clients the watcher doesn't manage
+type unmanagedBackend struct {
+	*memoryBackend
+	unmanaged map[string]bool
+}
+
+func (b *unmanagedBackend) Ensure(ctx context.Context, client *staticClient) error {
+	if b.unmanaged[client.Id] {
+		return fmt.Errorf("client '%s' %w", client.Id, errUnmanagedClient)
+	}
+	return b.memoryBackend.Ensure(ctx, client)
+}
+
+func (b *unmanagedBackend) Delete(ctx context.Context, client *staticClient) error {
+	if b.unmanaged[client.Id] {
+		return fmt.Errorf("client '%s' %w", client.Id, errUnmanagedClient)
+	}
+	return b.memoryBackend.Delete(ctx, client)
+}
+
+func TestReconcilerUnmanaged(t *testing.T) {
+	backend := &unmanagedBackend{memoryBackend: newMemoryBackend(), unmanaged: map[string]bool{"taken": true}}
+	recorder := record.NewFakeRecorder(100)
+	r := newReconciler(backend, recorder, nil, CollisionOldestWins)
+	ref := testRef("team-a", "app", 0)
+
+	r.apply(ref, []*staticClient{testClient("taken", "https://taken.example.com/callback")})
+	if events := recordedEvents(recorder); len(events) != 1 || !strings.HasPrefix(events[0], "Warning ClientIDConflict ") ||
+		!strings.Contains(events[0], "isn't managed by the watcher") {
+		t.Fatalf("expected a conflict event, got %v", events)
+	}
+	if r.registered["taken"] != nil || r.failed["taken"] != nil {
+		t.Error("unmanaged client recorded as registered or retried")
+	}
+
+	// Taken over after being registered
+	r.apply(ref, []*staticClient{testClient("app", "https://app.example.com/callback")})
+	backend.unmanaged["app"] = true
+	r.remove(ref)
+	if events := recordedEvents(recorder); len(events) != 1 || !strings.HasPrefix(events[0], "Warning ClientIDConflict ") {
+		t.Fatalf("expected a conflict event, got %v", events)
+	}
+	if r.registered["app"] != nil || r.failed["app"] != nil {
+		t.Error("client taken over still recorded as registered or retried")
+	}
+	if got := backendClients(t, backend); got["app"] == nil {
+		t.Error("client taken over deleted")
+	}
+}
+
+// Backend whose Ensure blocks for a client id until released
+type blockingBackend struct {
+	*memoryBackend
+	id       string
+	entered  chan struct{}
+	released chan struct{}
+}
+
+func (b *blockingBackend) Ensure(ctx context.Context, client *staticClient) error {
+	if client.Id == b.id {
+		close(b.entered)
+		<-b.released
+	}
+	return b.memoryBackend.Ensure(ctx, client)
+}
+
+func TestReconcilerSlowBackend(t *testing.T) {
+	backend := &blockingBackend{
+		memoryBackend: newMemoryBackend(),
+		id:            "slow",
+		entered:       make(chan struct{}),
+		released:      make(chan struct{}),
+	}
+	r := newReconciler(backend, record.NewFakeRecorder(100), nil, CollisionOldestWins)
+
+	done := make(chan struct{})
+	go func() {
+		r.apply(testRef("team-a", "slow", 0), []*staticClient{testClient("slow", "https://slow.example.com/callback")})
+		close(done)
+	}()
+	<-backend.entered
+
+	// Other clients and the policy aren't held up by the slow call
+	applied := make(chan struct{})
+	go func() {
+		r.apply(testRef("team-b", "fast", 0), []*staticClient{testClient("fast", "https://fast.example.com/callback")})
+		r.hasPolicy()
+		close(applied)
+	}()
+	select {
+	case <-applied:
+	case <-time.After(5 * time.Second):
+		t.Fatal("apply blocked by a backend call for another client")
+	}
+
+	close(backend.released)
+	<-done
+	if got := backendClients(t, backend); got["slow"] == nil || got["fast"] == nil {
+		t.Errorf("expected both clients, got %v", got)
+	}
+}
+
+func TestReconcilerCollisions(t *testing.T) {
+	older := testRef("team-a", "older", 0)
+	newer := testRef("team-b", "newer", 1)
+	newest := testRef("team-c", "newest", 2)
+	sameTime := testRef("team-0", "same-time", 1)
+
+	shared := func(uri string) *staticClient {
+		c := testClient("app", uri)
+		c.Shared = true
+		return c
+	}
+	otherSecret := func(uri string) *staticClient {
+		c := testClient("app", uri)
+		c.Secret = "other"
+		return c
+	}
+
+	type step struct {
+		ref    objectRef
+		client *staticClient
+		remove bool
+	}
+	tests := []struct {
+		name   string
+		policy string
+		// Objects listed on start, applied before the others
+		listing []step
+		steps   []step
+		// Redirect URIs of the registered client, nil if none
+		want []string
+		// Reasons and messages of the events recorded, in any order
+		wantEvents []string
+	}{
+		{
+			name:   "oldest wins",
+			policy: CollisionOldestWins,
+			steps: []step{
+				{ref: newer, client: testClient("app", "https://newer/cb")},
+				{ref: older, client: testClient("app", "https://older/cb")},
+			},
+			want:       []string{"https://older/cb"},
+			wantEvents: []string{"ClientIDConflict Dex client 'app' not registered: already defined by Ingress team-a/older"},
+		},
+		{
+			name:   "oldest wins, ties broken by key",
+			policy: CollisionOldestWins,
+			steps: []step{
+				{ref: newer, client: testClient("app", "https://newer/cb")},
+				{ref: sameTime, client: testClient("app", "https://same-time/cb")},
+			},
+			want:       []string{"https://same-time/cb"},
+			wantEvents: []string{"ClientIDConflict Dex client 'app' not registered: already defined by Ingress team-0/same-time"},
+		},
+		{
+			name:   "oldest wins, next oldest takes over",
+			policy: CollisionOldestWins,
+			steps: []step{
+				{ref: newest, client: testClient("app", "https://newest/cb")},
+				{ref: older, client: testClient("app", "https://older/cb")},
+				{ref: newer, client: testClient("app", "https://newer/cb")},
+				{ref: older, remove: true},
+			},
+			want: []string{"https://newer/cb"},
+			wantEvents: []string{
+				"ClientIDConflict Dex client 'app' not registered: already defined by Ingress team-a/older",
+				"ClientIDConflict Dex client 'app' not registered: already defined by Ingress team-b/newer",
+			},
+		},
+		{
+			name:   "reject keeps the first claim",
+			policy: CollisionReject,
+			steps: []step{
+				{ref: newer, client: testClient("app", "https://newer/cb")},
+				{ref: older, client: testClient("app", "https://older/cb")},
+			},
+			want:       []string{"https://newer/cb"},
+			wantEvents: []string{"ClientIDConflict Dex client 'app' not registered: already defined by Ingress team-b/newer"},
+		},
+		{
+			name:   "reject hands over in claim order",
+			policy: CollisionReject,
+			steps: []step{
+				{ref: newest, client: testClient("app", "https://newest/cb")},
+				{ref: newer, client: testClient("app", "https://newer/cb")},
+				{ref: older, client: testClient("app", "https://older/cb")},
+				{ref: newest, remove: true},
+			},
+			want: []string{"https://newer/cb"},
+			wantEvents: []string{
+				"ClientIDConflict Dex client 'app' not registered: already defined by Ingress team-c/newest",
+				"ClientIDConflict Dex client 'app' not registered: already defined by Ingress team-b/newer",
+			},
+		},
+		{
+			name:   "reject re-claim goes last",
+			policy: CollisionReject,
+			steps: []step{
+				{ref: older, client: testClient("app", "https://older/cb")},
+				{ref: newer, client: testClient("app", "https://newer/cb")},
+				{ref: older, client: testClient("other", "https://older/cb")},
+				{ref: older, client: testClient("app", "https://older/cb")},
+			},
+			want: []string{"https://newer/cb"},
+			wantEvents: []string{
+				"ClientIDConflict Dex client 'app' not registered: already defined by Ingress team-a/older",
+				"ClientIDConflict Dex client 'app' not registered: already defined by Ingress team-b/newer",
+			},
+		},
+		{
+			name:   "reject keeps the oldest listed on start",
+			policy: CollisionReject,
+			listing: []step{
+				{ref: newer, client: testClient("app", "https://newer/cb")},
+				{ref: older, client: testClient("app", "https://older/cb")},
+			},
+			steps: []step{
+				{ref: newest, client: testClient("app", "https://newest/cb")},
+			},
+			want: []string{"https://older/cb"},
+			wantEvents: []string{
+				"ClientIDConflict Dex client 'app' not registered: already defined by Ingress team-a/older",
+			},
+		},
+		{
+			name:   "reject hands over to the oldest listed on start",
+			policy: CollisionReject,
+			listing: []step{
+				{ref: newer, client: testClient("app", "https://newer/cb")},
+				{ref: sameTime, client: testClient("app", "https://same-time/cb")},
+				{ref: older, client: testClient("app", "https://older/cb")},
+			},
+			steps: []step{
+				{ref: newest, client: testClient("app", "https://newest/cb")},
+				{ref: older, remove: true},
+			},
+			want: []string{"https://same-time/cb"},
+			wantEvents: []string{
+				"ClientIDConflict Dex client 'app' not registered: already defined by Ingress team-0/same-time",
+				"ClientIDConflict Dex client 'app' not registered: already defined by Ingress team-a/older",
+			},
+		},
+		{
+			name:   "merge",
+			policy: CollisionMerge,
+			steps: []step{
+				{ref: newest, client: testClient("app", "https://newest/cb")},
+				{ref: older, client: testClient("app", "https://older/cb")},
+				{ref: newer, client: testClient("app", "https://newer/cb", "https://older/cb")},
+			},
+			want: []string{"https://older/cb", "https://newer/cb", "https://newest/cb"},
+		},
+		{
+			name:   "merge skips another secret",
+			policy: CollisionMerge,
+			steps: []step{
+				{ref: older, client: testClient("app", "https://older/cb")},
+				{ref: newer, client: otherSecret("https://newer/cb")},
+			},
+			want:       []string{"https://older/cb"},
+			wantEvents: []string{"ClientSecretMismatch Dex client 'app' not shared: secret differs from Ingress team-a/older"},
+		},
+		{
+			name:   "merge drops the redirect URIs of a removed object",
+			policy: CollisionMerge,
+			steps: []step{
+				{ref: older, client: testClient("app", "https://older/cb")},
+				{ref: newer, client: testClient("app", "https://newer/cb")},
+				{ref: older, remove: true},
+			},
+			want: []string{"https://newer/cb"},
+		},
+		{
+			name:   "shared clients merge under oldest wins",
+			policy: CollisionOldestWins,
+			steps: []step{
+				{ref: newer, client: shared("https://newer/cb")},
+				{ref: older, client: shared("https://older/cb")},
+			},
+			want: []string{"https://older/cb", "https://newer/cb"},
+		},
+		{
+			name:   "last owner removed",
+			policy: CollisionOldestWins,
+			steps: []step{
+				{ref: older, client: testClient("app", "https://older/cb")},
+				{ref: newer, client: testClient("app", "https://newer/cb")},
+				{ref: newer, remove: true},
+				{ref: older, remove: true},
+			},
+			wantEvents: []string{"ClientIDConflict Dex client 'app' not registered: already defined by Ingress team-a/older"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, backend, recorder := newTestReconciler(tt.policy)
+			apply := func(steps []step) {
+				for _, s := range steps {
+					if s.remove {
+						r.remove(s.ref)
+					} else {
+						r.apply(s.ref, []*staticClient{s.client})
+					}
+				}
+			}
+			apply(tt.listing)
+			r.setListed()
+			apply(tt.steps)
+
+			got := backendClients(t, backend)["app"]
+			switch {
+			case tt.want == nil && got != nil:
+				t.Errorf("expected no client, got %v", got.RedirectURIs)
+			case tt.want != nil && got == nil:
+				t.Errorf("expected a client with %v, got none", tt.want)
+			case tt.want != nil && !reflect.DeepEqual(got.RedirectURIs, tt.want):
+				t.Errorf("expected redirect URIs %v, got %v", tt.want, got.RedirectURIs)
+			}
+
+			events := make(map[string]bool)
+			for _, event := range recordedEvents(recorder) {
+				events[strings.TrimPrefix(event, "Warning ")] = true
+			}
+			want := make(map[string]bool)
+			for _, event := range tt.wantEvents {
+				want[event] = true
+			}
+			if !reflect.DeepEqual(events, want) {
+				t.Errorf("expected events %v, got %v", tt.wantEvents, events)
+			}
+		})
+	}
+}
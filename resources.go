@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/util/jsonpath"
+	"sigs.k8s.io/yaml"
+)
+
+// Resources of any kind to watch for clients, read from --resources-file
+type resourcesConfig struct {
+	Resources []*resourceMapping `json:"resources"`
+}
+
+// A resource to watch, and JSONPath expressions reading client settings from its
+// objects. Settings found override the annotations, which are read as for Ingresses.
+// Expressions are parsed again for each object, a parsed JSONPath keeps state
+// while searching and can't be shared between informers
+type resourceMapping struct {
+	Group    string `json:"group"`
+	Version  string `json:"version"`
+	Resource string `json:"resource"`
+	Kind     string `json:"kind"`
+	// Client id of the single client annotations
+	ClientID string `json:"clientID,omitempty"`
+	// Hosts, for templates and the namespace callback path
+	Hosts string `json:"hosts,omitempty"`
+	// Redirect URIs of the single client annotations
+	RedirectURIs string `json:"redirectURIs,omitempty"`
+}
+
+// Parse a YAML or JSON resources configuration
+func parseResourcesConfig(data []byte) (*resourcesConfig, error) {
+	data, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &resourcesConfig{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, err
+	}
+
+	for i, m := range c.Resources {
+		if m == nil || m.Version == "" || m.Resource == "" || m.Kind == "" {
+			return nil, fmt.Errorf("resource %d: version, resource and kind are required", i+1)
+		}
+		if _, err = parseJSONPath(m.ClientID); err != nil {
+			return nil, fmt.Errorf("resource %d: invalid clientID: %s", i+1, err)
+		}
+		if _, err = parseJSONPath(m.Hosts); err != nil {
+			return nil, fmt.Errorf("resource %d: invalid hosts: %s", i+1, err)
+		}
+		if _, err = parseJSONPath(m.RedirectURIs); err != nil {
+			return nil, fmt.Errorf("resource %d: invalid redirectURIs: %s", i+1, err)
+		}
+	}
+	return c, nil
+}
+
+// Read a resources configuration from a file
+func loadResourcesFile(path string) (*resourcesConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseResourcesConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resources file '%s': %s", path, err)
+	}
+	return c, nil
+}
+
+// Parse a JSONPath expression, returns nil for an empty one
+func parseJSONPath(expr string) (*jsonpath.JSONPath, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	j := jsonpath.New("").AllowMissingKeys(true)
+	if err := j.Parse(expr); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Return the values a JSONPath expression finds in an object, lists being
+// flattened and empty values dropped
+func findStrings(expr string, obj map[string]interface{}) ([]string, error) {
+	j, err := parseJSONPath(expr)
+	if err != nil || j == nil {
+		return nil, err
+	}
+	results, err := j.FindResults(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []string
+	var add func(v interface{})
+	add = func(v interface{}) {
+		switch v := v.(type) {
+		case nil:
+		case []interface{}:
+			for _, item := range v {
+				add(item)
+			}
+		case string:
+			if v != "" {
+				values = append(values, v)
+			}
+		default:
+			values = append(values, fmt.Sprint(v))
+		}
+	}
+	for _, result := range results {
+		for _, value := range result {
+			if value.IsValid() && value.CanInterface() {
+				add(value.Interface())
+			}
+		}
+	}
+	return values, nil
+}
+
+// Return the resource to watch
+func (m *resourceMapping) resource() schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: m.Group, Version: m.Version, Resource: m.Resource}
+}
+
+// Return the annotations of an object, with the ones found by the mapping added
+func (m *resourceMapping) annotations(o *unstructured.Unstructured) (map[string]string, error) {
+	ann := make(map[string]string)
+	for k, v := range o.GetAnnotations() {
+		ann[k] = v
+	}
+
+	ids, err := findStrings(m.ClientID, o.Object)
+	if err != nil {
+		return nil, fmt.Errorf("clientID: %s", err)
+	}
+	if len(ids) > 1 {
+		return nil, fmt.Errorf("clientID: %d values found", len(ids))
+	}
+	if len(ids) == 1 {
+		ann[annotationName(AnnotationDexStaticClientId)] = ids[0]
+	}
+
+	uris, err := findStrings(m.RedirectURIs, o.Object)
+	if err != nil {
+		return nil, fmt.Errorf("redirectURIs: %s", err)
+	}
+	if len(uris) > 0 {
+		ann[annotationName(AnnotationDexStaticClientRedirectURI)] = strings.Join(uris, ",")
+	}
+	return ann, nil
+}
+
+// Resource handler for the objects of a configured resource, read through the
+// dynamic client
+type DynamicResourceClient struct {
+	reconciler *reconciler
+	mapping    *resourceMapping
+}
+
+func NewDynamicResourceClient(r *reconciler, mapping *resourceMapping) *DynamicResourceClient {
+	return &DynamicResourceClient{
+		reconciler: r,
+		mapping:    mapping,
+	}
+}
+
+// Handle Client creation on event
+func (c *DynamicResourceClient) OnAdd(obj interface{}) {
+	kind := c.mapping.Kind
+
+	o, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		log.Warnf("Got an unexpected, unsupported, object. Not a %s", kind)
+		return
+	}
+
+	log.Debugf("Checking %s for clients '%s' from namespace '%s' ...", kind, o.GetName(), o.GetNamespace())
+
+	ref := newObjectRef(kind, c.mapping.resource(), o)
+	hosts, err := findStrings(c.mapping.Hosts, o.Object)
+	if err != nil {
+		c.reconciler.reject(ref, fmt.Errorf("hosts: %s", err))
+		return
+	}
+	ann, err := c.mapping.annotations(o)
+	if err != nil {
+		c.reconciler.reject(ref, err)
+		return
+	}
+
+	tdata := newTemplateData(kind, o, hosts)
+	tdata.Annotations = ann
+	clients, err := extractClients(ann, tdata)
+	reconcileObject(c.reconciler, ref, tdata, clients, err)
+}
+
+// Handle update event
+func (c *DynamicResourceClient) OnUpdate(oldObj, newObj interface{}) {
+	c.OnAdd(newObj)
+}
+
+// Handle deletion event
+func (c *DynamicResourceClient) OnDelete(obj interface{}) {
+	kind := c.mapping.Kind
+
+	o, ok := deletedObject(obj).(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	log.Debugf("Checking %s for client deletion for '%s' from namespace '%s' ...", kind, o.GetName(), o.GetNamespace())
+
+	c.reconciler.remove(newObjectRef(kind, c.mapping.resource(), o))
+}
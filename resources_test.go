@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestFindStringsConcurrent(t *testing.T) {
+	c, err := parseResourcesConfig([]byte(`
+resources:
+- version: v1
+  resource: things
+  kind: Thing
+  hosts: "{range .spec.rules[*]}{.host}{end}"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapping := c.Resources[0]
+	obj := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"rules": []interface{}{
+				map[string]interface{}{"host": "a.example.com"},
+				map[string]interface{}{"host": "b.example.com"},
+			},
+		},
+	}
+	want := []string{"a.example.com", "b.example.com"}
+
+	// Mappings are shared by the informers of every namespace
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				hosts, err := findStrings(mapping.Hosts, obj)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !reflect.DeepEqual(hosts, want) {
+					t.Errorf("expected %v, got %v", want, hosts)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
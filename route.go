@@ -0,0 +1,74 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// OpenShift Routes, read through the dynamic client
+var RouteResource = schema.GroupVersionResource{Group: "route.openshift.io", Version: "v1", Resource: "routes"}
+
+// Resource handler for OpenShift Routes
+type RouteClient struct {
+	reconciler *reconciler
+}
+
+func NewRouteClient(r *reconciler) *RouteClient {
+	return &RouteClient{
+		reconciler: r,
+	}
+}
+
+// Return the template values for a Route. Its host is served with https if it
+// has a TLS configuration, and plain http otherwise
+func routeTemplateData(kind string, o *unstructured.Unstructured) *templateData {
+	var hosts []string
+	if host, _, _ := unstructured.NestedString(o.Object, "spec", "host"); host != "" {
+		hosts = append(hosts, host)
+	}
+
+	data := newTemplateData(kind, o, hosts)
+	if tls, found, _ := unstructured.NestedMap(o.Object, "spec", "tls"); !found || tls == nil {
+		data.Scheme = "http"
+	}
+	return data
+}
+
+// Handle Client creation on Route event
+func (c *RouteClient) OnAdd(obj interface{}) {
+
+	const kind = "Route"
+
+	o, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		log.Warnf("Got an unexpected, unsupported, object. Not a Route")
+		return
+	}
+
+	log.Debugf("Checking %s for clients '%s' from namespace '%s' ...", kind, o.GetName(), o.GetNamespace())
+
+	tdata := routeTemplateData(kind, o)
+	clients, err := extractClients(o.GetAnnotations(), tdata)
+	reconcileObject(c.reconciler, newObjectRef(kind, RouteResource, o), tdata, clients, err)
+}
+
+// Handle Route update event
+func (c *RouteClient) OnUpdate(oldObj, newObj interface{}) {
+	c.OnAdd(newObj)
+}
+
+// Handle Route deletion event
+func (c *RouteClient) OnDelete(obj interface{}) {
+	const kind = "Route"
+
+	o, ok := deletedObject(obj).(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	log.Debugf("Checking %s for client deletion for '%s' from namespace '%s' ...", kind, o.GetName(), o.GetNamespace())
+
+	c.reconciler.remove(newObjectRef(kind, RouteResource, o))
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	BackendStaticConfig = "static-config"
+
+	// Lines between which the clients are rendered in the target key
+	StaticConfigBeginMarker = "# BEGIN dex-k8s-ingress-watcher"
+	StaticConfigEndMarker   = "# END dex-k8s-ingress-watcher"
+
+	// Pod template annotation set on Dex's Deployment to roll it out
+	AnnotationStaticConfigHash = "-config-hash"
+)
+
+// Backend rendering the clients into the staticClients of a Dex config held by a
+// ConfigMap or Secret. The clients are written between the begin and end
+// markers, the rest of the config, hand-written clients included, is kept.
+// Writes are debounced, and can trigger a rollout of Dex's Deployment. Nothing
+// is written before start, so that a partial list of clients isn't rendered
+// while the watched objects are first listed
+type staticConfigBackend struct {
+	client kubernetes.Interface
+	// Kind of the target, configmap or secret
+	kind      string
+	namespace string
+	name      string
+	key       string
+	// Dex's Deployment to roll out after a change, if any
+	deployment string
+	debounce   time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*staticClient
+	timer   *time.Timer
+	// Whether the watched objects were all listed, and writes can happen
+	started bool
+	// Error of the last write
+	err error
+
+	// Held while writing, so that an older list of clients can't overwrite a
+	// newer one
+	flushMu sync.Mutex
+}
+
+// Return a new backend writing to the key of the target, given as
+// configmap/NAMESPACE/NAME or secret/NAMESPACE/NAME, and rolling out the
+// deployment given as NAMESPACE/NAME if any
+func newStaticConfigBackend(client kubernetes.Interface, target string, key string, deployment string, debounce time.Duration) (*staticConfigBackend, error) {
+	parts := strings.SplitN(target, "/", 3)
+	if len(parts) != 3 || (parts[0] != "configmap" && parts[0] != "secret") {
+		return nil, fmt.Errorf("static config target must be given as configmap/NAMESPACE/NAME or secret/NAMESPACE/NAME, got '%s'", target)
+	}
+	if deployment != "" && len(strings.SplitN(deployment, "/", 2)) != 2 {
+		return nil, fmt.Errorf("static config deployment must be given as NAMESPACE/NAME, got '%s'", deployment)
+	}
+
+	return &staticConfigBackend{
+		client:     client,
+		kind:       parts[0],
+		namespace:  parts[1],
+		name:       parts[2],
+		key:        key,
+		deployment: deployment,
+		debounce:   debounce,
+		clients:    make(map[string]*staticClient),
+	}, nil
+}
+
+func (b *staticConfigBackend) Ensure(ctx context.Context, client *staticClient) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := *client
+	b.clients[client.Id] = &c
+	b.schedule()
+	return nil
+}
+
+func (b *staticConfigBackend) Delete(ctx context.Context, client *staticClient) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.clients, client.Id)
+	b.schedule()
+	return nil
+}
+
+func (b *staticConfigBackend) Get(ctx context.Context, id string) (*staticClient, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	client, ok := b.clients[id]
+	if !ok {
+		return nil, nil
+	}
+	c := *client
+	return &c, nil
+}
+
+func (b *staticConfigBackend) List(ctx context.Context) ([]*staticClient, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.sorted(), nil
+}
+
+func (b *staticConfigBackend) Health(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.err
+}
+
+// Return copies of the clients, sorted by id. Must be called with the lock held
+func (b *staticConfigBackend) sorted() []*staticClient {
+	clients := make([]*staticClient, 0, len(b.clients))
+	for _, client := range b.clients {
+		c := *client
+		clients = append(clients, &c)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Id < clients[j].Id
+	})
+	return clients
+}
+
+// Allow writes, once the clients of all watched objects are known. The clients
+// are written once no change happened for the debounce period, even without
+// any, to remove the stale ones
+func (b *staticConfigBackend) start() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.started = true
+	b.schedule()
+}
+
+// Write the clients once no change happened for the debounce period. Must be
+// called with the lock held
+func (b *staticConfigBackend) schedule() {
+	if !b.started {
+		return
+	}
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.timer = time.AfterFunc(b.debounce, b.flush)
+}
+
+// Write the current clients to the target. A write in progress is waited for,
+// the clients are read once it is done
+func (b *staticConfigBackend) flush() {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	clients := b.sorted()
+	b.mu.Unlock()
+
+	err := b.write(context.TODO(), clients)
+	if err != nil {
+		log.Errorf("Static config: failed to write clients to %s '%s' from namespace '%s' - %s", b.kind, b.name, b.namespace, err)
+	}
+
+	b.mu.Lock()
+	b.err = err
+	if err != nil {
+		// Try again later
+		b.schedule()
+	}
+	b.mu.Unlock()
+}
+
+// Render the clients into the target key, and roll Dex out if it changed
+func (b *staticConfigBackend) write(ctx context.Context, clients []*staticClient) error {
+	rendered, err := renderStaticClients(clients)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		changed = false
+		switch b.kind {
+		case "secret":
+			secret, err := b.client.CoreV1().Secrets(b.namespace).Get(ctx, b.name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			config, err := mergeStaticClients(string(secret.Data[b.key]), rendered)
+			if err != nil || config == string(secret.Data[b.key]) {
+				return err
+			}
+			secret.Data[b.key] = []byte(config)
+			changed = true
+			_, err = b.client.CoreV1().Secrets(b.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+			return err
+		default:
+			cm, err := b.client.CoreV1().ConfigMaps(b.namespace).Get(ctx, b.name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			config, err := mergeStaticClients(cm.Data[b.key], rendered)
+			if err != nil || config == cm.Data[b.key] {
+				return err
+			}
+			cm.Data[b.key] = config
+			changed = true
+			_, err = b.client.CoreV1().ConfigMaps(b.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+			return err
+		}
+	})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return fmt.Errorf("%s not found", b.kind)
+		}
+		return err
+	}
+	if !changed {
+		return nil
+	}
+	log.Infof("Static config: Successfully wrote %d clients to %s '%s' from namespace '%s'", len(clients), b.kind, b.name, b.namespace)
+
+	if b.deployment == "" {
+		return nil
+	}
+	return b.rollout(ctx, rendered)
+}
+
+// Roll Dex's Deployment out, by setting a hash of the clients on its pod template
+func (b *staticConfigBackend) rollout(ctx context.Context, rendered string) error {
+	parts := strings.SplitN(b.deployment, "/", 2)
+	sum := sha256.Sum256([]byte(rendered))
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]interface{}{
+						annotationName(AnnotationStaticConfigHash): hex.EncodeToString(sum[:]),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = b.client.AppsV1().Deployments(parts[0]).Patch(ctx, parts[1], types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to roll out Deployment '%s': %s", b.deployment, err)
+	}
+	log.Infof("Static config: rolling out Deployment '%s'", b.deployment)
+	return nil
+}
+
+// Render clients as the items of a staticClients list
+func renderStaticClients(clients []*staticClient) (string, error) {
+	if len(clients) == 0 {
+		return "", nil
+	}
+	items := make([]map[string]interface{}, 0, len(clients))
+	for _, client := range clients {
+		item := map[string]interface{}{
+			"id":           client.Id,
+			"name":         client.Name,
+			"redirectURIs": client.RedirectURIs,
+		}
+		if client.Secret != "" {
+			item["secret"] = client.Secret
+		}
+		if len(client.TrustedPeers) > 0 {
+			item["trustedPeers"] = client.TrustedPeers
+		}
+		if client.Public {
+			item["public"] = true
+		}
+		if client.LogoURL != "" {
+			item["logoURL"] = client.LogoURL
+		}
+		items = append(items, item)
+	}
+	data, err := yaml.Marshal(items)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Replace the lines between the markers of a config with the rendered clients,
+// indented as the begin marker
+func mergeStaticClients(config string, rendered string) (string, error) {
+	lines := strings.Split(config, "\n")
+	begin, end := -1, -1
+	for i, line := range lines {
+		switch strings.TrimSpace(line) {
+		case StaticConfigBeginMarker:
+			begin = i
+		case StaticConfigEndMarker:
+			end = i
+		}
+	}
+	if begin < 0 || end < begin {
+		return "", fmt.Errorf("no '%s' and '%s' lines in the config", StaticConfigBeginMarker, StaticConfigEndMarker)
+	}
+
+	indent := lines[begin][:len(lines[begin])-len(strings.TrimLeft(lines[begin], " "))]
+	var clients []string
+	for _, line := range strings.Split(strings.TrimRight(rendered, "\n"), "\n") {
+		if line != "" {
+			clients = append(clients, indent+line)
+		}
+	}
+
+	merged := append([]string(nil), lines[:begin+1]...)
+	merged = append(merged, clients...)
+	merged = append(merged, lines[end:]...)
+	return strings.Join(merged, "\n"), nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const testStaticConfig = `staticClients:
+- id: auth
+  secret: secret
+  redirectURIs:
+  - https://auth.example.com/callback
+# BEGIN dex-k8s-ingress-watcher
+- id: stale
+  redirectURIs:
+  - https://stale.example.com/callback
+# END dex-k8s-ingress-watcher
+`
+
+// Return a static config backend writing to a fake ConfigMap
+func newTestStaticConfig(t *testing.T) (*staticConfigBackend, *fake.Clientset) {
+	client := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-auth", Name: "dex"},
+		Data:       map[string]string{"config.yaml": testStaticConfig},
+	})
+	b, err := newStaticConfigBackend(client, "configmap/kube-auth/dex", "config.yaml", "", 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, client
+}
+
+// Return the config once written, after the given number of writes
+func waitStaticConfig(t *testing.T, client *fake.Clientset, writes int) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		updates := 0
+		for _, action := range client.Actions() {
+			if action.GetVerb() == "update" {
+				updates++
+			}
+		}
+		if updates >= writes {
+			// Let a write in progress finish
+			time.Sleep(50 * time.Millisecond)
+			cm, err := client.CoreV1().ConfigMaps("kube-auth").Get(context.Background(), "dex", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return cm.Data["config.yaml"]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d writes", writes)
+	return ""
+}
+
+func TestStaticConfigStart(t *testing.T) {
+	b, client := newTestStaticConfig(t)
+	ctx := context.Background()
+
+	if err := b.Ensure(ctx, &staticClient{Id: "app", RedirectURIs: []string{"https://app.example.com/callback"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ctx, &staticClient{Id: "app"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Fatalf("expected no write before start, got %v", actions)
+	}
+
+	// Written once started, even without clients
+	b.start()
+	config := waitStaticConfig(t, client, 1)
+	if strings.Contains(config, "stale") || !strings.Contains(config, "id: auth") {
+		t.Errorf("expected the stale clients to be removed, got:\n%s", config)
+	}
+}
+
+func TestStaticConfigRollout(t *testing.T) {
+	saved := annotationPrefixes
+	defer func() { annotationPrefixes = saved }()
+	annotationPrefixes = []string{"example.com/sso"}
+
+	client := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-auth", Name: "dex"},
+			Data:       map[string]string{"config.yaml": testStaticConfig},
+		},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-auth", Name: "dex"}},
+	)
+	b, err := newStaticConfigBackend(client, "configmap/kube-auth/dex", "config.yaml", "kube-auth/dex", 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.start()
+	waitStaticConfig(t, client, 1)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		d, err := client.AppsV1().Deployments("kube-auth").Get(context.Background(), "dex", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Spec.Template.Annotations["example.com/sso-config-hash"] != "" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("expected the config hash under the annotation prefix")
+}
+
+// Client whose ConfigMap updates call a hook before being made, outside of the
+// lock the fake clientset holds while handling a call
+type hookedClient struct {
+	*fake.Clientset
+	beforeUpdate func()
+}
+
+type hookedCoreV1 struct {
+	typedcorev1.CoreV1Interface
+	beforeUpdate func()
+}
+
+type hookedConfigMaps struct {
+	typedcorev1.ConfigMapInterface
+	beforeUpdate func()
+}
+
+func (c *hookedClient) CoreV1() typedcorev1.CoreV1Interface {
+	return &hookedCoreV1{CoreV1Interface: c.Clientset.CoreV1(), beforeUpdate: c.beforeUpdate}
+}
+
+func (c *hookedCoreV1) ConfigMaps(namespace string) typedcorev1.ConfigMapInterface {
+	return &hookedConfigMaps{ConfigMapInterface: c.CoreV1Interface.ConfigMaps(namespace), beforeUpdate: c.beforeUpdate}
+}
+
+func (c *hookedConfigMaps) Update(ctx context.Context, cm *v1.ConfigMap, opts metav1.UpdateOptions) (*v1.ConfigMap, error) {
+	c.beforeUpdate()
+	return c.ConfigMapInterface.Update(ctx, cm, opts)
+}
+
+func TestStaticConfigSerialisedWrites(t *testing.T) {
+	fakeClient := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-auth", Name: "dex"},
+		Data:       map[string]string{"config.yaml": testStaticConfig},
+	})
+
+	// Hold the first write until released
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	client := &hookedClient{Clientset: fakeClient, beforeUpdate: func() {
+		first := false
+		once.Do(func() { first = true })
+		if first {
+			close(entered)
+			<-release
+		}
+	}}
+	b, err := newStaticConfigBackend(client, "configmap/kube-auth/dex", "config.yaml", "", 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	b.start()
+	if err := b.Ensure(ctx, &staticClient{Id: "a", RedirectURIs: []string{"https://a.example.com/callback"}}); err != nil {
+		t.Fatal(err)
+	}
+	<-entered
+
+	// Changed while the first write is in progress
+	if err := b.Ensure(ctx, &staticClient{Id: "b", RedirectURIs: []string{"https://b.example.com/callback"}}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	config := waitStaticConfig(t, fakeClient, 2)
+	if !strings.Contains(config, "id: a") || !strings.Contains(config, "id: b") {
+		t.Errorf("expected the latest clients, got:\n%s", config)
+	}
+	if err := b.Health(ctx); err != nil {
+		t.Error(err)
+	}
+}
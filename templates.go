@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Cluster domain available to templates, set by flag
+var clusterDomain string
+
+// Extra variables available to templates, set by flag
+var templateVars = map[string]string{}
+
+// Values available to the client-name and redirect-uri templates
+type templateData struct {
+	Kind        string
+	Namespace   string
+	Name        string
+	Labels      map[string]string
+	Annotations map[string]string
+	// Hosts the object serves, if any
+	Hosts []string
+	// Host a redirect URI is expanded for, one of Hosts
+	Host string
+	// Scheme the hosts are served with, http for Routes without TLS
+	Scheme        string
+	ClusterDomain string
+	Vars          map[string]string
+}
+
+// Return the template values for an object serving the given hosts
+func newTemplateData(kind string, o metav1.Object, hosts []string) *templateData {
+	return &templateData{
+		Kind:          kind,
+		Namespace:     o.GetNamespace(),
+		Name:          o.GetName(),
+		Labels:        o.GetLabels(),
+		Annotations:   o.GetAnnotations(),
+		Hosts:         hosts,
+		Scheme:        "https",
+		ClusterDomain: clusterDomain,
+		Vars:          templateVars,
+	}
+}
+
+// Expand a template with the given values. Text without any action is
+// returned as is
+func expandTemplate(text string, data *templateData) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	t, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Expand the templates in the name and redirect URIs of a client. Redirect URIs
+// are expanded for every host of the object, so a template using .Host gives
+// one URI per host. Wildcard hosts are skipped, Dex matches redirect URIs verbatim
+func expandClient(client *staticClient, data *templateData) error {
+	name, err := expandTemplate(client.Name, data)
+	if err != nil {
+		return fmt.Errorf("client '%s': invalid name template: %s", client.Id, err)
+	}
+	client.Name = name
+
+	var hosts []string
+	for _, host := range data.Hosts {
+		if !strings.Contains(host, "*") {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		hosts = []string{""}
+	}
+
+	var redirectURIs []string
+	seen := make(map[string]bool)
+	for _, uri := range client.RedirectURIs {
+		for _, host := range hosts {
+			hostData := *data
+			hostData.Host = host
+			expanded, err := expandTemplate(uri, &hostData)
+			if err != nil {
+				return fmt.Errorf("client '%s': invalid redirect uri template: %s", client.Id, err)
+			}
+			if !seen[expanded] {
+				seen[expanded] = true
+				redirectURIs = append(redirectURIs, expanded)
+			}
+		}
+	}
+	client.RedirectURIs = redirectURIs
+	return nil
+}
+
+// Expand the templates of a list of clients
+func expandClients(clients []*staticClient, data *templateData) error {
+	for _, client := range clients {
+		if client == nil {
+			continue
+		}
+		if err := expandClient(client, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
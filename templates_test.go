@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestExpandClientHosts(t *testing.T) {
+	o := &metav1.ObjectMeta{Namespace: "team-a", Name: "app"}
+	tests := []struct {
+		name  string
+		hosts []string
+		uri   string
+		want  []string
+		// Whether what is left isn't a valid redirect URI
+		invalid bool
+	}{
+		{
+			name:  "one uri per host",
+			hosts: []string{"a.example.com", "b.example.com", "a.example.com"},
+			uri:   "https://{{.Host}}/callback",
+			want:  []string{"https://a.example.com/callback", "https://b.example.com/callback"},
+		},
+		{
+			name:  "wildcard hosts skipped",
+			hosts: []string{"*.example.com", "app.example.com"},
+			uri:   "https://{{.Host}}/callback",
+			want:  []string{"https://app.example.com/callback"},
+		},
+		{
+			name:    "only wildcard hosts",
+			hosts:   []string{"*.example.com"},
+			uri:     "https://{{.Host}}/callback",
+			want:    []string{"https:///callback"},
+			invalid: true,
+		},
+		{
+			name:  "without host",
+			hosts: []string{"*.example.com"},
+			uri:   "https://{{.Namespace}}.example.com/callback",
+			want:  []string{"https://team-a.example.com/callback"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &staticClient{Id: "app", RedirectURIs: []string{tt.uri}}
+			if err := expandClient(client, newTemplateData("Ingress", o, tt.hosts)); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(client.RedirectURIs, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, client.RedirectURIs)
+			}
+			if _, err := validateRedirectURIs(client.RedirectURIs); (err != nil) != tt.invalid {
+				t.Errorf("unexpected validation result %v", err)
+			}
+		})
+	}
+}
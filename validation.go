@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Hosts allowed in plain http redirect URIs, set by flag
+var insecureRedirectHosts = []string{"localhost", "127.0.0.1", "::1"}
+
+// Check the redirect URIs of a client, and return them without duplicates.
+// URIs must be absolute https URIs without a fragment or wildcard host, plain
+// http is only allowed for the hosts given by --insecure-redirect-host
+func validateRedirectURIs(uris []string) ([]string, error) {
+	var valid []string
+	seen := make(map[string]bool)
+
+	for i, uri := range uris {
+		if uri == "" {
+			return nil, fmt.Errorf("redirect uri %d is empty", i+1)
+		}
+
+		u, err := url.Parse(uri)
+		if err != nil {
+			return nil, fmt.Errorf("redirect uri '%s' is invalid: %s", uri, err)
+		}
+		if !u.IsAbs() || u.Host == "" {
+			return nil, fmt.Errorf("redirect uri '%s' must be absolute", uri)
+		}
+		if u.Fragment != "" || strings.Contains(uri, "#") {
+			return nil, fmt.Errorf("redirect uri '%s' must not have a fragment", uri)
+		}
+		if u.User != nil {
+			return nil, fmt.Errorf("redirect uri '%s' must not have user info", uri)
+		}
+		if strings.Contains(u.Hostname(), "*") {
+			return nil, fmt.Errorf("redirect uri '%s' must not have a wildcard host", uri)
+		}
+
+		switch strings.ToLower(u.Scheme) {
+		case "https":
+		case "http":
+			if !isInsecureRedirectHost(u.Hostname()) {
+				return nil, fmt.Errorf("redirect uri '%s' must use https", uri)
+			}
+		default:
+			return nil, fmt.Errorf("redirect uri '%s' has unsupported scheme '%s'", uri, u.Scheme)
+		}
+
+		// Keep the URI as written, Dex compares them verbatim
+		key := normalizeRedirectURI(u)
+		if !seen[key] {
+			seen[key] = true
+			valid = append(valid, uri)
+		}
+	}
+
+	return valid, nil
+}
+
+// Return whether plain http redirect URIs are allowed for a host
+func isInsecureRedirectHost(host string) bool {
+	for _, h := range insecureRedirectHosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return a redirect URI in a canonical form, to spot duplicates. Scheme and
+// host are lowercased, and default ports removed
+func normalizeRedirectURI(u *url.URL) string {
+	n := *u
+	n.Scheme = strings.ToLower(n.Scheme)
+
+	host, port := strings.ToLower(n.Hostname()), n.Port()
+	if (n.Scheme == "https" && port == "443") || (n.Scheme == "http" && port == "80") {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	n.Host = host
+	return n.String()
+}